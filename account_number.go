@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+)
+
+// Account numbers are 10 digits: 9 random digits followed by a Luhn check
+// digit, so most typos are caught before a lookup ever hits the database.
+const (
+	accountNumberMin = 1000000000
+	accountNumberMax = 9999999999
+
+	// accountNumberAttempts bounds retries when a generated number is taken.
+	accountNumberAttempts = 5
+)
+
+// newAccountNumber returns a random, Luhn-valid 10-digit account number.
+func newAccountNumber() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000000))
+	if err != nil {
+		return 0, err
+	}
+	payload := n.Int64() + 100000000 // 9 digits, no leading zero
+	return payload*10 + luhnCheckDigit(payload), nil
+}
+
+// validAccountNumber reports whether number has the right length and a
+// correct check digit.
+func validAccountNumber(number int64) bool {
+	if number < accountNumberMin || number > accountNumberMax {
+		return false
+	}
+	return luhnCheckDigit(number/10) == number%10
+}
+
+// luhnCheckDigit computes the digit that makes payload followed by the
+// digit pass the Luhn check.
+func luhnCheckDigit(payload int64) int64 {
+	var sum int64
+	double := true
+	for ; payload > 0; payload /= 10 {
+		d := payload % 10
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// assignAccountNumbers gives every account without a valid, unique number a
+// freshly generated one. It runs as a migration step for both SQL backends.
+func assignAccountNumbers(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, COALESCE(number, 0) FROM accounts ORDER BY id ASC`)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		id     int
+		number int64
+	}
+	var accounts []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.number); err != nil {
+			rows.Close()
+			return err
+		}
+		accounts = append(accounts, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	taken := map[int64]bool{}
+	var renumber []int
+	for _, account := range accounts {
+		if validAccountNumber(account.number) && !taken[account.number] {
+			taken[account.number] = true
+			continue
+		}
+		renumber = append(renumber, account.id)
+	}
+
+	for _, id := range renumber {
+		number, err := newAccountNumber()
+		if err != nil {
+			return err
+		}
+		for taken[number] {
+			if number, err = newAccountNumber(); err != nil {
+				return err
+			}
+		}
+		taken[number] = true
+
+		if _, err := tx.Exec(`UPDATE accounts SET number = $1 WHERE id = $2`, number, id); err != nil {
+			return fmt.Errorf("assigning number to account ID %d: %w", id, err)
+		}
+	}
+	return nil
+}
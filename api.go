@@ -1,52 +1,142 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
-
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret []byte
+// accessClaims are the claims of an access token. ID is the jti that
+// revocation works by and SessionID the refresh token family it belongs to.
+// Role and Permissions are informational, for clients deciding what to
+// show; the server always checks the user's current role.
+type accessClaims struct {
+	UserID      int          `json:"user_id"`
+	Role        Role         `json:"role"`
+	Permissions []Permission `json:"permissions"`
+	SessionID   string       `json:"sid"`
+	jwt.RegisteredClaims
+}
 
-func createJWT(user *User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+func (s *APIServer) createJWT(user *User, jti, sessionID string, expiresAt time.Time) (string, error) {
+	return s.keys.sign(accessClaims{
+		UserID:      user.ID,
+		Role:        user.Role,
+		Permissions: user.Role.Permissions(),
+		SessionID:   sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(s.now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
 	})
-
-	// fmt.Printf(token.SignedString(jwtSecret)) //token printing (debug)
-	return token.SignedString(jwtSecret)
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+// validateJWT checks the token's signature and expiry and that it hasn't
+// been revoked.
+func (s *APIServer) validateJWT(ctx context.Context, tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc, jwt.WithExpirationRequired(), jwt.WithTimeFunc(s.now))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	// Access tokens have no audience; tokens that do are meant for
+	// something else, like finishing a two-factor login.
+	if claims.ID == "" || claims.UserID == 0 || len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("%w: not an access token", ErrInvalidToken)
+	}
+
+	revoked, err := s.store.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
 }
 
 type APIServer struct {
 	listenAddr string
 	store      Storage
+	keys       *KeySet
+
+	// totpTransferThreshold is the largest transfer users with two-factor
+	// authentication can make without a TOTP code.
+	totpTransferThreshold int64
+
+	// now is the server's clock. Token expiry and TOTP codes are checked
+	// against it, so tests can fix it.
+	now func() time.Time
+
+	// mailer sends verification and password reset emails, with links to
+	// the frontend at appURL.
+	mailer Mailer
+	appURL string
+
+	passwords *PasswordPolicy
+
+	// corsOrigins are the origins browsers may call the API from; "*"
+	// allows any.
+	corsOrigins []string
+
+	// Feature toggles
+	registrationEnabled  bool
+	requireVerifiedEmail bool
+
+	timeouts ServerTimeouts
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+// ServerTimeouts bound how long the HTTP server waits on clients. Shutdown
+// is how long Run waits for requests in flight once it is told to stop. DB
+// bounds the database work of each request, so a slow database fails
+// requests instead of piling them up.
+type ServerTimeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+	Shutdown   time.Duration
+	DB         time.Duration
+}
+
+func defaultServerTimeouts() ServerTimeouts {
+	return ServerTimeouts{
+		ReadHeader: 5 * time.Second,
+		Read:       15 * time.Second,
+		Write:      30 * time.Second,
+		Idle:       2 * time.Minute,
+		Shutdown:   30 * time.Second,
+		DB:         10 * time.Second,
+	}
+}
+
+func NewAPIServer(listenAddr string, store Storage, keys *KeySet) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:            listenAddr,
+		store:                 store,
+		keys:                  keys,
+		totpTransferThreshold: defaultTOTPTransferThreshold,
+		now:                   time.Now,
+		mailer:                LogMailer{},
+		appURL:                defaultAppURL,
+		passwords:             defaultPasswordPolicy(),
+		corsOrigins:           []string{"*"},
+		registrationEnabled:   true,
+		requireVerifiedEmail:  true,
+		timeouts:              defaultServerTimeouts(),
 	}
 }
 
@@ -58,30 +148,125 @@ type CreateUserRequest struct {
 	Password  string `json:"password"`
 }
 
-func (s *APIServer) Run() {
+// Run serves the API until ctx is done. It then stops accepting
+// connections and waits up to the shutdown timeout for requests in flight,
+// such as transfers, to finish. It returns nil after a clean shutdown.
+func (s *APIServer) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           s.routes(),
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		ReadTimeout:       s.timeouts.Read,
+		WriteTimeout:      s.timeouts.Write,
+		IdleTimeout:       s.timeouts.Idle,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	slog.Info("JSON API server running", "addr", listener.Addr().String())
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down; waiting for requests in flight", "timeout", s.timeouts.Shutdown)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.timeouts.Shutdown)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// routes builds the API's router.
+func (s *APIServer) routes() http.Handler {
 	router := mux.NewRouter()
 
 	// CORS middleware
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			enableCors(w, r)
+			s.enableCors(w, r)
 			next.ServeHTTP(w, r)
 		})
 	})
 
-	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleUser))
-	router.HandleFunc("/account/{id}", makeHTTPHandleFunc(s.handleDeleteUser)).Methods("DELETE")
-	router.HandleFunc("/account/{id}", makeHTTPHandleFunc(s.handleGetUserById))
-	router.HandleFunc("/transfer", makeHTTPHandleFunc(s.handleTransfer)).Methods("POST", "OPTIONS")
-	router.HandleFunc("/register", makeHTTPHandleFunc(s.handleRegister)).Methods("POST", "OPTIONS")
-	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin)).Methods("POST", "OPTIONS")
-	router.HandleFunc("/balance/{id}", makeHTTPHandleFunc(s.handleGetBalance)).Methods("GET")
-	router.HandleFunc("/transactions/{id}", makeHTTPHandleFunc(s.handleGetTransactions)).Methods("GET")
-	router.HandleFunc("/user-by-email/{email}", makeHTTPHandleFunc(s.handleGetUserByEmail)).Methods("GET")
-	router.HandleFunc("/user-details/{email}", makeHTTPHandleFunc(s.handleGetUserDetails)).Methods("GET")
+	// Database calls made for a request share its context, so they are
+	// cut off once the DB timeout has passed or the client has gone away
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), s.timeouts.DB)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
 
-	log.Println("JSON API server running on port: ", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	// Preflight requests are answered by the CORS middleware above.
+	router.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Public routes
+	// /register answers with a session, and idempotent responses are stored
+	// as they are, so it isn't wrapped: tokens are only ever stored hashed
+	router.HandleFunc("/register", makeHTTPHandleFunc(s.handleRegister)).Methods("POST")
+	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin)).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", makeHTTPHandleFunc(s.handleJWKS)).Methods("GET")
+	router.HandleFunc("/login/totp", makeHTTPHandleFunc(s.handleLoginTOTP)).Methods("POST")
+	router.HandleFunc("/token/refresh", makeHTTPHandleFunc(s.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/verify-email", makeHTTPHandleFunc(s.handleVerifyEmail)).Methods("POST")
+	router.HandleFunc("/password-reset", makeHTTPHandleFunc(s.handleRequestPasswordReset)).Methods("POST")
+	router.HandleFunc("/password-reset/confirm", makeHTTPHandleFunc(s.handleConfirmPasswordReset)).Methods("POST")
+
+	// Everything else needs a valid token. Handlers check ownership and
+	// permissions.
+	api := router.NewRoute().Subrouter()
+	api.Use(s.authenticate)
+
+	api.HandleFunc("/logout", makeHTTPHandleFunc(s.handleLogout)).Methods("POST")
+	api.HandleFunc("/logout/all", makeHTTPHandleFunc(s.handleLogoutAll)).Methods("POST")
+	api.HandleFunc("/me", makeHTTPHandleFunc(s.handleGetMe)).Methods("GET")
+	api.HandleFunc("/me", makeHTTPHandleFunc(s.handleUpdateMe)).Methods("PATCH")
+	api.HandleFunc("/me/password", makeHTTPHandleFunc(s.handleChangePassword)).Methods("POST")
+	api.HandleFunc("/me/totp", makeHTTPHandleFunc(s.handleEnrollTOTP)).Methods("POST")
+	api.HandleFunc("/me/totp", makeHTTPHandleFunc(s.handleDisableTOTP)).Methods("DELETE")
+	api.HandleFunc("/me/totp/confirm", makeHTTPHandleFunc(s.handleConfirmTOTP)).Methods("POST")
+	api.HandleFunc("/me/totp/recovery-codes", makeHTTPHandleFunc(s.handleRegenerateRecoveryCodes)).Methods("POST")
+	api.HandleFunc("/me/verification-email", makeHTTPHandleFunc(s.handleResendVerificationEmail)).Methods("POST")
+	api.HandleFunc("/account", s.idempotent(makeHTTPHandleFunc(s.handleUser)))
+	api.HandleFunc("/account/{id}", s.idempotent(makeHTTPHandleFunc(s.handleDeleteUser))).Methods("DELETE")
+	api.HandleFunc("/account/{id}", makeHTTPHandleFunc(s.handleGetUserById))
+	api.HandleFunc("/transfer", s.idempotent(makeHTTPHandleFunc(s.handleTransfer))).Methods("POST")
+	api.HandleFunc("/balance/{id}", makeHTTPHandleFunc(s.handleGetBalance)).Methods("GET")
+	api.HandleFunc("/transactions/{id}", makeHTTPHandleFunc(s.handleGetTransactions)).Methods("GET")
+	api.HandleFunc("/user-by-email/{email}", makeHTTPHandleFunc(s.handleGetUserByEmail)).Methods("GET")
+	api.HandleFunc("/user-details/{email}", makeHTTPHandleFunc(s.handleGetUserDetails)).Methods("GET")
+	api.HandleFunc("/users/{id}/accounts", makeHTTPHandleFunc(s.handleGetUserAccounts)).Methods("GET")
+	api.HandleFunc("/users/{id}/sessions", makeHTTPHandleFunc(s.handleRevokeUserSessions)).Methods("DELETE")
+	api.HandleFunc("/users/{id}/lockout", makeHTTPHandleFunc(s.handleUnlockUser)).Methods("DELETE")
+	api.HandleFunc("/lockouts", makeHTTPHandleFunc(s.handleGetLockouts)).Methods("GET")
+	api.HandleFunc("/lockouts/{id}", makeHTTPHandleFunc(s.handleUnlockLockout)).Methods("DELETE")
+	api.HandleFunc("/users/{id}/role", s.idempotent(makeHTTPHandleFunc(s.handleSetUserRole))).Methods("PUT")
+	api.HandleFunc("/accounts", s.idempotent(makeHTTPHandleFunc(s.handleOpenAccount))).Methods("POST")
+	api.HandleFunc("/accounts/by-number/{number}", makeHTTPHandleFunc(s.handleGetAccountByNumber)).Methods("GET")
+	api.HandleFunc("/accounts/{id}", makeHTTPHandleFunc(s.handleGetAccount)).Methods("GET")
+	api.HandleFunc("/accounts/{id}", s.idempotent(makeHTTPHandleFunc(s.handleCloseAccount))).Methods("DELETE")
+	api.HandleFunc("/accounts/{id}/balance", makeHTTPHandleFunc(s.handleGetAccountBalance)).Methods("GET")
+	api.HandleFunc("/accounts/{id}/transactions", makeHTTPHandleFunc(s.handleGetAccountTransactions)).Methods("GET")
+	api.HandleFunc("/accounts/{id}/adjustments", s.idempotent(makeHTTPHandleFunc(s.handleAdjustBalance))).Methods("POST")
+	api.HandleFunc("/ledger/entries", makeHTTPHandleFunc(s.handleGetJournalEntries)).Methods("GET")
+	api.HandleFunc("/ledger/entries/{id}", makeHTTPHandleFunc(s.handleGetJournalEntry)).Methods("GET")
+	api.HandleFunc("/ledger/reconciliation", makeHTTPHandleFunc(s.handleReconcileLedger)).Methods("GET")
+
+	return router
 }
 
 func (s *APIServer) handleUser(w http.ResponseWriter, r *http.Request) error {
@@ -95,12 +280,17 @@ func (s *APIServer) handleUser(w http.ResponseWriter, r *http.Request) error {
 		return s.handleDeleteUser(w, r)
 	}
 
-	return fmt.Errorf("method not allowed! %s", r.Method)
+	return validationError("method not allowed: %s", r.Method)
 }
 
-// GET /account
+// GET /account lists all users to staff who may view users. Everyone else
+// only gets their own record; payees are confirmed by account number.
 func (s *APIServer) handleGetUser(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetUsers()
+	if requirePermission(r, PermViewUsers) != nil {
+		return WriteJSON(w, http.StatusOK, []*User{currentUser(r)})
+	}
+
+	accounts, err := s.store.GetUsers(r.Context())
 	if err != nil {
 		return err
 	}
@@ -111,58 +301,82 @@ func (s *APIServer) handleGetUserById(w http.ResponseWriter, r *http.Request) er
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid account ID: %s", idStr)
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	if err := authorizeUser(r, id, PermViewUsers); err != nil {
+		return err
 	}
 
-	account, err := s.store.GetUserByID(id)
+	account, err := s.store.GetUserByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
 	if account == nil {
-		return fmt.Errorf("account not found with ID: %d", id)
+		return fmt.Errorf("%w with ID: %d", ErrUserNotFound, id)
 	}
 
 	return WriteJSON(w, http.StatusOK, account)
 }
 
+// POST /account creates a user on their behalf. Admins only; customers
+// sign up through /register.
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	//debugging purposes
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
+	ctx := r.Context()
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
 		return err
 	}
-	log.Println("Request Body:", string(body))
-
-	//needed to include this to navigate EOF error
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
 	createUserReq := new(CreateUserRequest)
-	if err := json.NewDecoder(r.Body).Decode(createUserReq); err != nil {
+	if err := decodeJSON(r, createUserReq); err != nil {
 		return err
 	}
 
-	account, err := NewUser(createUserReq.FirstName, createUserReq.LastName, createUserReq.Email, createUserReq.Password)
+	if err := s.validateCreateUser(createUserReq); err != nil {
+		return err
+	}
+	hashedPassword, err := s.passwords.Hash(createUserReq.Password)
 	if err != nil {
 		return err
 	}
 
-	if err := s.store.CreateUser(account); err != nil {
+	account := NewUser(createUserReq.FirstName, createUserReq.LastName, createUserReq.Email, hashedPassword)
+	if err := s.createUser(ctx, account); err != nil {
 		return err
 	}
 
+	if err := s.sendVerificationEmail(ctx, account); err != nil {
+		slog.Error("sending verification email failed", "user_id", account.ID, "err", err)
+	}
+
 	return WriteJSON(w, http.StatusOK, account)
 }
 
+// DELETE /account/{id} deletes a user. Admins only.
 func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid user ID: %s", idStr)
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
+		return err
+	}
+
+	user, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user != nil && user.SystemKey != "" {
+		return ErrSystemUser
 	}
 
 	// Attempt to delete the account
-	if err := s.store.DeleteUser(id); err != nil {
+	if err := s.store.DeleteUser(ctx, id); err != nil {
 		return err
 	}
 
@@ -172,83 +386,207 @@ func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) err
 }
 
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	log.Println("Starting transfer process")
-
+	ctx := r.Context()
 	transferReq := new(TransferRequest)
-	if err := json.NewDecoder(r.Body).Decode(transferReq); err != nil {
-		log.Printf("Error decoding transfer request: %v", err)
+	if err := decodeJSON(r, transferReq); err != nil {
 		return err
 	}
-	log.Printf("Transfer request decoded: %+v", transferReq)
 
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Println("Missing Authorization header")
-		return fmt.Errorf("missing Authorization header")
+	if transferReq.Amount <= 0 {
+		return ErrInvalidAmount
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := validateJWT(tokenString)
-	if err != nil {
-		log.Printf("Invalid token: %v", err)
-		return fmt.Errorf("invalid token")
+	user := currentUser(r)
+	userID := user.ID
+
+	if s.requireVerifiedEmail && !user.EmailVerified {
+		return ErrEmailNotVerified
 	}
-	log.Println("JWT token validated successfully")
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		log.Println("Invalid token claims")
-		return fmt.Errorf("invalid token claims")
+	fromAccountID := transferReq.FromAccountID
+	if fromAccountID == 0 {
+		account, err := s.primaryAccount(ctx, userID)
+		if err != nil {
+			return err
+		}
+		fromAccountID = int64(account.ID)
+	} else {
+		account, err := s.store.GetAccountByID(ctx, int(fromAccountID))
+		if err != nil {
+			return err
+		}
+		if account == nil || account.UserID != userID {
+			return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, fromAccountID)
+		}
 	}
 
-	userID, ok := claims["user_id"].(float64)
-	if !ok {
-		log.Println("Invalid user ID in token")
-		return fmt.Errorf("invalid user ID in token")
+	to, err := s.recipientAccount(ctx, transferReq)
+	if err != nil {
+		return err
 	}
-	log.Printf("User ID extracted from token: %v", userID)
 
-	err = s.store.TransferFunds(int64(userID), transferReq.ToID, transferReq.Amount)
+	if user.TOTPEnabled && transferReq.Amount > s.totpTransferThreshold {
+		// Wrong codes count as failed logins, so a stolen access token
+		// can't be used to guess them.
+		email, ip := normalizeEmail(user.Email), clientIP(r)
+		if err := s.checkLoginAllowed(ctx, w, email, ip); err != nil {
+			return err
+		}
+		if err := s.verifyTOTP(ctx, user, transferReq.TOTPCode); err != nil {
+			if errors.Is(err, ErrInvalidTOTPCode) {
+				if err := s.loginFailed(ctx, email, ip, user); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+	}
+
+	err = s.store.TransferFunds(ctx, fromAccountID, int64(to.ID), transferReq.Amount)
 	if err != nil {
-		log.Printf("Error during transfer: %v", err)
+		slog.Info("transfer failed", "user_id", userID, "from_account_id", fromAccountID, "to_account_id", to.ID, "err", err)
 		return err
 	}
 
-	log.Println("Transfer completed successfully")
+	slog.Info("transfer completed", "user_id", userID, "from_account_id", fromAccountID, "to_account_id", to.ID,
+		"amount", transferReq.Amount)
 	return WriteJSON(w, http.StatusOK, map[string]string{"message": "Transfer successful"})
 }
 
+// TransferRequest moves Amount between two accounts. FromAccountID defaults
+// to the caller's primary account. The recipient is ToAccountID, or the
+// account with ToAccountNumber, or else the primary account of user ToID.
 type TransferRequest struct {
-	ToID   int64 `json:"toId"`
-	Amount int64 `json:"amount"`
+	FromAccountID   int64 `json:"fromAccountId"`
+	ToAccountID     int64 `json:"toAccountId"`
+	ToAccountNumber int64 `json:"toAccountNumber"`
+	ToID            int64 `json:"toId"`
+	Amount          int64 `json:"amount"`
+
+	// TOTPCode is required above the TOTP transfer threshold for users with
+	// two-factor authentication enabled.
+	TOTPCode string `json:"totpCode"`
+}
+
+// recipientAccount resolves the account a transfer pays into. System
+// accounts can't be paid directly and are reported as unknown.
+func (s *APIServer) recipientAccount(ctx context.Context, req *TransferRequest) (*Account, error) {
+	var account *Account
+	var err error
+	switch {
+	case req.ToAccountID != 0:
+		account, err = s.store.GetAccountByID(ctx, int(req.ToAccountID))
+		if err == nil && account == nil {
+			err = fmt.Errorf("%w (account ID %d)", ErrUnknownRecipient, req.ToAccountID)
+		}
+	case req.ToAccountNumber != 0:
+		if !validAccountNumber(req.ToAccountNumber) {
+			return nil, fmt.Errorf("%w: %d", ErrInvalidAccountNumber, req.ToAccountNumber)
+		}
+		account, err = s.store.GetAccountByNumber(ctx, req.ToAccountNumber)
+		if err == nil && account == nil {
+			err = fmt.Errorf("%w (account number %d)", ErrUnknownRecipient, req.ToAccountNumber)
+		}
+	case req.ToID != 0:
+		account, err = s.primaryAccount(ctx, int(req.ToID))
+		if errors.Is(err, ErrAccountNotFound) {
+			err = fmt.Errorf("%w (user ID %d)", ErrUnknownRecipient, req.ToID)
+		}
+	default:
+		return nil, ErrNoRecipient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if account.Type == AccountSystem {
+		return nil, fmt.Errorf("%w (account ID %d)", ErrUnknownRecipient, account.ID)
+	}
+	if account.Status != AccountOpen {
+		return nil, fmt.Errorf("%w (account ID %d)", ErrAccountClosed, account.ID)
+	}
+
+	return account, nil
+}
+
+// claimsFromRequest validates the bearer token on r and returns its claims.
+func (s *APIServer) claimsFromRequest(r *http.Request) (*accessClaims, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, fmt.Errorf("%w: missing Authorization header", ErrUnauthorized)
+	}
+
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	claims, err := s.validateJWT(r.Context(), tokenString)
+	if err != nil {
+		slog.Debug("invalid access token", "err", err)
+		return nil, err
+	}
+
+	return claims, nil
 }
 
 func (s *APIServer) handleRegister(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	if !s.registrationEnabled {
+		return ErrRegistrationDisabled
+	}
+
 	createUserReq := new(CreateUserRequest)
-	if err := json.NewDecoder(r.Body).Decode(createUserReq); err != nil {
+	if err := decodeJSON(r, createUserReq); err != nil {
 		return err
 	}
 
-	user, err := NewUser(createUserReq.FirstName, createUserReq.LastName, createUserReq.Email, createUserReq.Password)
+	if err := s.validateCreateUser(createUserReq); err != nil {
+		return err
+	}
+	hashedPassword, err := s.passwords.Hash(createUserReq.Password)
 	if err != nil {
 		return err
 	}
 
-	if err := s.store.CreateUser(user); err != nil {
+	user := NewUser(createUserReq.FirstName, createUserReq.LastName, createUserReq.Email, hashedPassword)
+	if err := s.createUser(ctx, user); err != nil {
 		return err
 	}
 
-	token, err := createJWT(user)
+	// The user can ask for another email if this one doesn't arrive, so a
+	// mail failure doesn't fail the registration.
+	if err := s.sendVerificationEmail(ctx, user); err != nil {
+		slog.Error("sending verification email failed", "user_id", user.ID, "err", err)
+	}
+
+	resp, err := s.issueTokens(ctx, user, "")
 	if err != nil {
 		return err
 	}
 
-	resp := LoginResponse{
-		Token: token,
-		User:  user,
+	return WriteJSON(w, http.StatusCreated, resp)
+}
+
+// createUser stores a new user, their first password in the history and a
+// checking account. If a step after the first fails, the user is deleted
+// again, so the email isn't left taken by a user without an account.
+func (s *APIServer) createUser(ctx context.Context, user *User) error {
+	if err := s.store.CreateUser(ctx, user); err != nil {
+		return err
 	}
 
-	return WriteJSON(w, http.StatusCreated, resp)
+	err := s.recordPassword(ctx, user)
+	if err == nil {
+		err = s.store.CreateAccount(ctx, NewAccount(user.ID, AccountChecking))
+	}
+	if err != nil {
+		// The request may have timed out, which must not stop the clean-up
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.timeouts.DB)
+		defer cancel()
+		if delErr := s.store.DeleteUser(cleanupCtx, user.ID); delErr != nil {
+			slog.Error("removing partly created user failed", "user_id", user.ID, "err", delErr)
+		}
+		return err
+	}
+	return nil
 }
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
@@ -259,24 +597,40 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
+// ApiError is the body of every error response. Error is a human-readable
+// message and Code a stable identifier from errors.go.
 type ApiError struct {
-	Error string
+	Error  string
+	Code   string       `json:"code"`
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			writeError(w, requestError(r, err))
 		}
 	}
 }
 
+// decodeJSON reads the request body into v. A body that isn't valid JSON is
+// reported as a validation error.
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return validationError("invalid request body: %v", err)
+	}
+	return nil
+}
+
 // CORS middleware
-func enableCors(w http.ResponseWriter, r *http.Request) {
-	log.Println("Received CORS request:", r.Method)
-	w.Header().Set("Access-Control-Allow-Origin", "*")                            // Allow all origins
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")  // Allowed methods
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization") // Allowed headers
+func (s *APIServer) enableCors(w http.ResponseWriter, r *http.Request) {
+	if origin := s.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")       // Allowed methods
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key") // Allowed headers
+	w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
 
 	// Handle preflight requests
 	if r.Method == http.MethodOptions {
@@ -285,45 +639,75 @@ func enableCors(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" if the origin isn't allowed.
+func (s *APIServer) allowedOrigin(origin string) string {
+	for _, allowed := range s.corsOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	loginReq := new(LoginRequest)
-	if err := json.NewDecoder(r.Body).Decode(loginReq); err != nil {
-		log.Printf("Error decoding login request: %v", err)
+	if err := decodeJSON(r, loginReq); err != nil {
 		return err
 	}
 
-	user, err := s.store.GetUserByEmail(loginReq.Email)
-	if err != nil {
-		log.Printf("Error getting user by email: %v", err)
-		return fmt.Errorf("invalid credentials")
+	email, ip := normalizeEmail(loginReq.Email), clientIP(r)
+	if err := s.checkLoginAllowed(ctx, w, email, ip); err != nil {
+		return err
 	}
 
-	if user == nil {
-		log.Printf("User not found for email: %s", loginReq.Email)
-		return fmt.Errorf("invalid credentials")
+	user, err := s.store.GetUserByEmail(ctx, loginReq.Email)
+	if errors.Is(err, ErrUserNotFound) {
+		user = nil
+	} else if err != nil {
+		return err
+	}
+	// System users can't log in; they are treated like unknown emails
+	if user != nil && user.SystemKey != "" {
+		user = nil
 	}
 
-	log.Printf("Retrieved user from database - Email: %s, Hashed Password: %s", user.Email, user.Password)
-
-	log.Printf("Comparing passwords for user: %s", loginReq.Email)
-	log.Printf("Stored hashed password: %s", user.Password)
-	log.Printf("Provided password: %s", loginReq.Password)
+	// Unknown emails and wrong passwords get the same answer, so it can't
+	// be used to find out which emails have accounts.
+	if !s.passwords.Compare(user, loginReq.Password) {
+		slog.Info("failed login", "email", email, "ip", ip)
+		if err := s.loginFailed(ctx, email, ip, user); err != nil {
+			return err
+		}
+		return ErrInvalidCredentials
+	}
+	s.upgradePasswordHash(ctx, user, loginReq.Password)
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password)); err != nil {
-		log.Printf("Password comparison failed: %v", err)
-		return fmt.Errorf("incorrect password")
+	// Users with two-factor authentication finish at /login/totp
+	if user.TOTPEnabled {
+		mfaToken, err := s.createMFAToken(user)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, MFAChallenge{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresIn:   int(mfaTokenTTL.Seconds()),
+		})
 	}
 
-	// Generate JWT token
-	token, err := createJWT(user)
-	if err != nil {
-		log.Printf("Error creating JWT: %v", err)
+	if err := s.store.ClearLoginFailures(ctx, ScopeAccount, email); err != nil {
 		return err
 	}
 
-	resp := LoginResponse{
-		Token: token,
-		User:  user,
+	// Start a new session
+	resp, err := s.issueTokens(ctx, user, "")
+	if err != nil {
+		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, resp)
@@ -334,19 +718,35 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// LoginResponse starts or continues a session. Token is the access token
+// and expires after ExpiresIn seconds; RefreshToken gets a new pair from
+// /token/refresh.
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  *User  `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+	User         *User  `json:"user"`
 }
 
+// GET /balance/{id} returns the balance of the user's primary account.
 func (s *APIServer) handleGetBalance(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid user ID: %s", idStr)
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	if err := authorizeUser(r, id, PermViewAccounts); err != nil {
+		return err
 	}
 
-	balance, err := s.store.GetBalance(id)
+	account, err := s.primaryAccount(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetBalance(ctx, account.ID)
 	if err != nil {
 		return err
 	}
@@ -354,14 +754,25 @@ func (s *APIServer) handleGetBalance(w http.ResponseWriter, r *http.Request) err
 	return WriteJSON(w, http.StatusOK, map[string]int64{"balance": balance})
 }
 
+// GET /transactions/{id} returns the transactions of the user's primary account.
 func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid user ID: %s", idStr)
+		return validationError("invalid user ID: %s", idStr)
 	}
 
-	transactions, err := s.store.GetTransactions(id)
+	if err := authorizeUser(r, id, PermViewAccounts); err != nil {
+		return err
+	}
+
+	account, err := s.primaryAccount(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := s.store.GetTransactions(ctx, account.ID)
 	if err != nil {
 		return err
 	}
@@ -369,6 +780,312 @@ func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request
 	return WriteJSON(w, http.StatusOK, transactions)
 }
 
+// primaryAccount returns the user's oldest open checking account, which is
+// used wherever an endpoint identifies a user instead of an account.
+func (s *APIServer) primaryAccount(ctx context.Context, userID int) (*Account, error) {
+	accounts, err := s.store.GetAccountsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		if account.Type == AccountChecking && account.Status == AccountOpen {
+			return account, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no open checking account for user ID %d", ErrAccountNotFound, userID)
+}
+
+// GET /users/{id}/accounts
+func (s *APIServer) handleGetUserAccounts(w http.ResponseWriter, r *http.Request) error {
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	if err := authorizeUser(r, id, PermViewAccounts); err != nil {
+		return err
+	}
+
+	accounts, err := s.store.GetAccountsByUser(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, accounts)
+}
+
+type SetRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// PUT /users/{id}/role assigns a role. Admins only, and not to themselves,
+// so the last admin can't lock everyone out by accident.
+func (s *APIServer) handleSetUserRole(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
+		return err
+	}
+	if id == currentUser(r).ID {
+		return newError(KindForbidden, ErrForbidden.Code, "you cannot change your own role")
+	}
+
+	roleReq := new(SetRoleRequest)
+	if err := decodeJSON(r, roleReq); err != nil {
+		return err
+	}
+	if !roleReq.Role.Valid() {
+		return validationError("invalid role: %q", roleReq.Role)
+	}
+
+	user, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w with ID: %d", ErrUserNotFound, id)
+	}
+	if user.SystemKey != "" {
+		return ErrSystemUser
+	}
+
+	if err := s.store.SetRole(ctx, user.ID, roleReq.Role); err != nil {
+		return err
+	}
+	user.Role = roleReq.Role
+
+	return WriteJSON(w, http.StatusOK, user)
+}
+
+// POST /accounts opens a new account for the authenticated user.
+func (s *APIServer) handleOpenAccount(w http.ResponseWriter, r *http.Request) error {
+	userID := currentUser(r).ID
+
+	openReq := new(OpenAccountRequest)
+	if err := decodeJSON(r, openReq); err != nil {
+		return err
+	}
+
+	if openReq.Type == "" {
+		openReq.Type = AccountChecking
+	}
+	if !openReq.Type.Valid() {
+		return fmt.Errorf("%w: %s", ErrInvalidAccountType, openReq.Type)
+	}
+
+	account := NewAccount(userID, openReq.Type)
+	if err := s.store.CreateAccount(r.Context(), account); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, account)
+}
+
+// GET /accounts/{id}
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accountFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeAccount(r, account, PermViewAccounts); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// DELETE /accounts/{id} closes one of the authenticated user's accounts.
+// Tellers and admins can close anyone's.
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accountFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeAccount(r, account, PermManageAccounts); err != nil {
+		return err
+	}
+
+	if err := s.store.CloseAccount(r.Context(), account.ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// GET /accounts/{id}/balance
+func (s *APIServer) handleGetAccountBalance(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accountFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeAccount(r, account, PermViewAccounts); err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetBalance(r.Context(), account.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int64{"balance": balance})
+}
+
+// GET /accounts/{id}/transactions
+func (s *APIServer) handleGetAccountTransactions(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accountFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeAccount(r, account, PermViewAccounts); err != nil {
+		return err
+	}
+
+	transactions, err := s.store.GetTransactions(r.Context(), account.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, transactions)
+}
+
+type AdjustBalanceRequest struct {
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// POST /accounts/{id}/adjustments credits (positive amount) or debits
+// (negative amount) an account outside of a transfer, e.g. for a cash
+// deposit at the counter. Tellers and admins only.
+func (s *APIServer) handleAdjustBalance(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	if err := requirePermission(r, PermManageAccounts); err != nil {
+		return err
+	}
+
+	account, err := s.accountFromPath(r)
+	if err != nil {
+		return err
+	}
+	if account.Type == AccountSystem {
+		return fmt.Errorf("%w with ID: %d", ErrAccountNotFound, account.ID)
+	}
+
+	adjustReq := new(AdjustBalanceRequest)
+	if err := decodeJSON(r, adjustReq); err != nil {
+		return err
+	}
+	if adjustReq.Amount == 0 {
+		return newError(KindValidation, ErrInvalidAmount.Code, "adjustment amount cannot be zero")
+	}
+	if strings.TrimSpace(adjustReq.Reason) == "" {
+		return validationError("an adjustment needs a reason")
+	}
+
+	description := fmt.Sprintf("adjustment of account %d by %s: %s", account.ID, currentUser(r).Email, adjustReq.Reason)
+	if err := s.store.AdjustBalance(ctx, int64(account.ID), adjustReq.Amount, description); err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetBalance(ctx, account.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int64{"balance": balance})
+}
+
+// AccountLookup is the public view of an account returned by number lookups:
+// enough to confirm who is being paid, without internal IDs or balances.
+type AccountLookup struct {
+	Number    int64         `json:"number"`
+	Type      AccountType   `json:"type"`
+	Status    AccountStatus `json:"status"`
+	FirstName string        `json:"firstName"`
+	LastName  string        `json:"lastName"`
+}
+
+// GET /accounts/by-number/{number}
+func (s *APIServer) handleGetAccountByNumber(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	numberStr := mux.Vars(r)["number"]
+	number, err := strconv.ParseInt(numberStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAccountNumber, numberStr)
+	}
+
+	account, err := s.accountByNumber(ctx, number)
+	if err != nil {
+		return err
+	}
+
+	owner, err := s.store.GetUserByID(ctx, account.UserID)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		return fmt.Errorf("%w with number: %d", ErrAccountNotFound, number)
+	}
+
+	return WriteJSON(w, http.StatusOK, AccountLookup{
+		Number:    account.Number,
+		Type:      account.Type,
+		Status:    account.Status,
+		FirstName: owner.FirstName,
+		LastName:  owner.LastName,
+	})
+}
+
+// accountByNumber checks the number's check digit before looking it up.
+func (s *APIServer) accountByNumber(ctx context.Context, number int64) (*Account, error) {
+	if !validAccountNumber(number) {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidAccountNumber, number)
+	}
+
+	account, err := s.store.GetAccountByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return nil, fmt.Errorf("%w with number: %d", ErrAccountNotFound, number)
+	}
+
+	return account, nil
+}
+
+// accountFromPath loads the account named by the {id} route variable.
+func (s *APIServer) accountFromPath(r *http.Request) (*Account, error) {
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, validationError("invalid account ID: %s", idStr)
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return nil, fmt.Errorf("%w with ID: %d", ErrAccountNotFound, id)
+	}
+
+	return account, nil
+}
+
 // func (s *APIServer) handleGetBalance(w http.ResponseWriter, r *http.Request) error {
 //     id := mux.Vars(r)["id"]
 //     // Convert id to int and fetch balance from database
@@ -388,20 +1105,32 @@ func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request
 // }
 
 func (s *APIServer) handleGetUserByEmail(w http.ResponseWriter, r *http.Request) error {
-	email := mux.Vars(r)["email"]
-	user, err := s.store.GetUserByEmail(email)
+	email := normalizeEmail(mux.Vars(r)["email"])
+	if email != currentUser(r).Email {
+		if err := requirePermission(r, PermViewUsers); err != nil {
+			return err
+		}
+	}
+
+	user, err := s.store.GetUserByEmail(r.Context(), email)
 	if err != nil {
 		return err
 	}
 	if user == nil {
-		return fmt.Errorf("user not found with email: %s", email)
+		return fmt.Errorf("%w with email: %s", ErrUserNotFound, email)
 	}
 	return WriteJSON(w, http.StatusOK, user)
 }
 
 func (s *APIServer) handleGetUserDetails(w http.ResponseWriter, r *http.Request) error {
-	email := mux.Vars(r)["email"]
-	user, err := s.store.GetUserByEmail(email)
+	email := normalizeEmail(mux.Vars(r)["email"])
+	if email != currentUser(r).Email {
+		if err := requirePermission(r, PermViewUsers); err != nil {
+			return err
+		}
+	}
+
+	user, err := s.store.GetUserByEmail(r.Context(), email)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+)
+
+// authenticate is router middleware that requires a valid bearer token. It
+// loads the token's user and stores it and the token's claims in the
+// request context, where handlers get them back with currentUser and
+// currentClaims.
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.claimsFromRequest(r)
+		if err != nil {
+			writeError(w, requestError(r, err))
+			return
+		}
+
+		user, err := s.store.GetUserByID(r.Context(), claims.UserID)
+		if err != nil {
+			writeError(w, requestError(r, err))
+			return
+		}
+		if user == nil {
+			writeError(w, fmt.Errorf("%w: user no longer exists", ErrInvalidToken))
+			return
+		}
+		// Sessions issued before a user became a system user end here
+		if user.SystemKey != "" {
+			writeError(w, fmt.Errorf("%w: system users can't log in", ErrInvalidToken))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// currentUser returns the authenticated user, or nil on public routes.
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// currentClaims returns the claims of the request's access token, or nil on
+// public routes.
+func currentClaims(r *http.Request) *accessClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*accessClaims)
+	return claims
+}
+
+// Permission is something a user may do to data that isn't their own.
+// Everyone may manage their own accounts; roles grant permissions on top.
+type Permission string
+
+const (
+	// PermViewUsers allows listing all users and reading any user's record.
+	PermViewUsers Permission = "users:read"
+	// PermManageUsers allows creating and deleting users and assigning roles.
+	PermManageUsers Permission = "users:write"
+	// PermViewAccounts allows reading any user's accounts, balances and
+	// transactions.
+	PermViewAccounts Permission = "accounts:read"
+	// PermManageAccounts allows closing any account and adjusting balances.
+	PermManageAccounts Permission = "accounts:write"
+	// PermViewLedger allows reading journal entries and reconciliation.
+	PermViewLedger Permission = "ledger:read"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleCustomer: {},
+	RoleTeller:   {PermViewUsers, PermViewAccounts, PermManageAccounts},
+	RoleAuditor:  {PermViewUsers, PermViewAccounts, PermViewLedger},
+	RoleAdmin:    {PermViewUsers, PermManageUsers, PermViewAccounts, PermManageAccounts, PermViewLedger},
+}
+
+// Permissions returns what the role grants. Unknown roles grant nothing.
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission checks that the authenticated user's role grants perm.
+func requirePermission(r *http.Request, perm Permission) error {
+	user := currentUser(r)
+	if user == nil {
+		return ErrUnauthorized
+	}
+
+	if !user.Role.Can(perm) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorizeUser checks that the authenticated user may act on the data of
+// the user with userID: their own, or anyone's if their role grants perm.
+func authorizeUser(r *http.Request, userID int, perm Permission) error {
+	user := currentUser(r)
+	if user == nil {
+		return ErrUnauthorized
+	}
+
+	if user.ID != userID && !user.Role.Can(perm) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorizeAccount checks that the authenticated user may act on account.
+func authorizeAccount(r *http.Request, account *Account, perm Permission) error {
+	return authorizeUser(r, account.UserID, perm)
+}
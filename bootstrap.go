@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// System accounts belong to the bank rather than a customer: the mint that
+// issues money, fees collects charges and suspense holds money that can't
+// be booked to the right account yet. The Monopoly Bank is a system user
+// with a well-funded checking account that transfers can be tested
+// against. All of them are found by a stable key and created at startup if
+// they are missing, so restarting the server never duplicates them.
+const (
+	feesSystemKey     = "fees"
+	suspenseSystemKey = "suspense"
+
+	monopolySystemKey      = "monopoly_bank"
+	monopolyEmail          = "monopoly@bank.invalid"
+	monopolyOpeningBalance = 999999999
+
+	// legacyMonopolyEmail is the email earlier versions created the
+	// Monopoly Bank under, with a hard-coded password.
+	legacyMonopolyEmail = "admin@gmail.com"
+)
+
+var systemAccountKeys = []string{mintSystemKey, feesSystemKey, suspenseSystemKey}
+
+// bootstrapSystemAccounts creates the system accounts, the Monopoly Bank
+// and the first admin, or brings existing ones in line with the
+// configuration.
+func bootstrapSystemAccounts(ctx context.Context, store Storage, cfg *Config, passwords *PasswordPolicy) error {
+	for _, key := range systemAccountKeys {
+		account, err := store.EnsureSystemAccount(ctx, key)
+		if err != nil {
+			return fmt.Errorf("system account %s: %w", key, err)
+		}
+		slog.Debug("system account ready", "system_key", key, "account_id", account.ID)
+	}
+
+	if err := bootstrapMonopolyBank(ctx, store); err != nil {
+		return err
+	}
+	return bootstrapAdmin(ctx, store, cfg, passwords)
+}
+
+// bootstrapMonopolyBank makes sure the Monopoly Bank user exists and has an
+// open account. It is a system user without a password, so nobody can log
+// in as it.
+func bootstrapMonopolyBank(ctx context.Context, store Storage) error {
+	user, err := store.GetUserBySystemKey(ctx, monopolySystemKey)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		// Earlier versions created the Monopoly Bank without a key; adopt it
+		user, err = store.GetUserByEmail(ctx, legacyMonopolyEmail)
+		if errors.Is(err, ErrUserNotFound) {
+			user, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if user == nil {
+		user = &User{
+			FirstName: "Monopoly",
+			LastName:  "Bank",
+			CreatedAt: time.Now().UTC(),
+		}
+		reconcileSystemUser(user)
+		if err := store.CreateUser(ctx, user); err != nil {
+			return fmt.Errorf("creating Monopoly Bank user: %w", err)
+		}
+		slog.Info("created Monopoly Bank user", "user_id", user.ID)
+	} else if reconcileSystemUser(user) {
+		if err := store.UpdateUser(ctx, user); err != nil {
+			return fmt.Errorf("updating Monopoly Bank user: %w", err)
+		}
+		slog.Info("reset Monopoly Bank user", "user_id", user.ID)
+	}
+
+	accounts, err := store.GetAccountsByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if account.Status == AccountOpen {
+			return nil
+		}
+	}
+
+	account := NewAccount(user.ID, AccountChecking)
+	account.Balance = monopolyOpeningBalance
+	if err := store.CreateAccount(ctx, account); err != nil {
+		return fmt.Errorf("opening Monopoly Bank account: %w", err)
+	}
+	slog.Info("opened Monopoly Bank account", "user_id", user.ID, "account_id", account.ID)
+	return nil
+}
+
+// reconcileSystemUser marks user as the Monopoly Bank and reports whether
+// anything changed. System users are customers without a password and with
+// an address nobody receives mail at.
+func reconcileSystemUser(user *User) bool {
+	changed := user.SystemKey != monopolySystemKey || user.Role != RoleCustomer || !user.EmailVerified ||
+		user.Email != monopolyEmail || user.Password != "" || user.TOTPEnabled
+	user.SystemKey = monopolySystemKey
+	user.Role = RoleCustomer
+	user.EmailVerified = true
+	user.Email = monopolyEmail
+	user.Password = ""
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	return changed
+}
+
+// bootstrapAdmin creates the first admin from ADMIN_EMAIL and
+// ADMIN_PASSWORD if no user has that email yet. An existing user is left
+// alone, so the admin can change their password through the API.
+func bootstrapAdmin(ctx context.Context, store Storage, cfg *Config, passwords *PasswordPolicy) error {
+	if cfg.AdminEmail == "" {
+		return nil
+	}
+
+	email := normalizeEmail(cfg.AdminEmail)
+	existing, err := store.GetUserByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if existing != nil {
+		if existing.Role != RoleAdmin {
+			slog.Warn("ADMIN_EMAIL belongs to a user who isn't an admin; leaving them as they are", "user_id", existing.ID)
+		}
+		return nil
+	}
+
+	if err := passwords.Validate(cfg.AdminPassword); err != nil {
+		return fmt.Errorf("ADMIN_PASSWORD: %w", err)
+	}
+	hashed, err := passwords.Hash(cfg.AdminPassword)
+	if err != nil {
+		return err
+	}
+
+	admin := NewUser("Bank", "Admin", email, hashed)
+	admin.Role = RoleAdmin
+	admin.EmailVerified = true
+	if err := store.CreateUser(ctx, admin); err != nil {
+		return fmt.Errorf("creating admin user: %w", err)
+	}
+	if err := store.AddPasswordHistory(ctx, admin.ID, admin.Password, passwords.History); err != nil {
+		return err
+	}
+	if err := store.CreateAccount(ctx, NewAccount(admin.ID, AccountChecking)); err != nil {
+		return fmt.Errorf("opening admin account: %w", err)
+	}
+	slog.Info("created admin user from ADMIN_EMAIL", "user_id", admin.ID)
+	return nil
+}
+
+// ensureSystemAccount is the shared SQL implementation of
+// Storage.EnsureSystemAccount.
+func ensureSystemAccount(ctx context.Context, db *sql.DB, key string) (*Account, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Look first so the usual case doesn't use up an ID; ON CONFLICT covers
+	// a concurrent insert.
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM accounts WHERE system_key = $1)`, key).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		_, err = tx.ExecContext(ctx, `INSERT INTO accounts (user_id, type, balance, status, created_at, system_key)
+			VALUES (NULL, $1, 0, $2, $3, $4) ON CONFLICT (system_key) DO NOTHING`,
+			AccountSystem, AccountOpen, time.Now().UTC(), key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET type = $1, status = $2, user_id = NULL
+		WHERE system_key = $3 AND (type <> $1 OR status <> $2 OR user_id IS NOT NULL)`,
+		AccountSystem, AccountOpen, key)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := scanAccount(tx.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE system_key = $1`, key))
+	if err != nil {
+		return nil, err
+	}
+	return account, tx.Commit()
+}
+
+func getUserBySystemKey(ctx context.Context, db *sql.DB, key string) (*User, error) {
+	user, err := scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE system_key = $1`, key))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return user, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestBootstrapAdminNormalizesEmail starts twice with a mixed-case
+// ADMIN_EMAIL. The admin must be stored in lower case, found again on the
+// second start and not created twice.
+func TestBootstrapAdminNormalizesEmail(t *testing.T) {
+	cfg := &Config{AdminEmail: " Admin@Bank.Example ", AdminPassword: "Plum-Orchard-Lantern-42"}
+
+	forEachStore(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		for start := 1; start <= 2; start++ {
+			if err := bootstrapAdmin(ctx, store, cfg, defaultPasswordPolicy()); err != nil {
+				t.Fatalf("start %d: %v", start, err)
+			}
+		}
+
+		users, err := store.GetUsers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var admins []*User
+		for _, user := range users {
+			if normalizeEmail(user.Email) == "admin@bank.example" {
+				admins = append(admins, user)
+			}
+		}
+		if len(admins) != 1 {
+			t.Fatalf("got %d admin users, want 1", len(admins))
+		}
+		if admins[0].Email != "admin@bank.example" || admins[0].Role != RoleAdmin {
+			t.Errorf("admin is %q with role %q, want admin@bank.example with role %q", admins[0].Email, admins[0].Role, RoleAdmin)
+		}
+	})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is the server's configuration. Every setting has a command-line
+// flag and an environment variable: -listen-addr and LISTEN_ADDR, and so
+// on. A flag wins over the environment, which wins over the config file,
+// which wins over the default.
+//
+// The config file holds KEY=VALUE lines like a .env file. It is named by
+// -config or CONFIG_FILE; without either, .env is read if it exists.
+type Config struct {
+	ListenAddr  string
+	Storage     string
+	DatabaseURL string
+	SQLitePath  string
+	AppURL      string
+	CORSOrigins []string
+
+	JWTSecret     string
+	JWTKeys       string
+	JWTSigningKey string
+
+	// AdminEmail and AdminPassword are the login of the first admin, who
+	// is created at startup if no user has that email yet.
+	AdminEmail    string
+	AdminPassword string
+
+	LogLevel  string
+	LogFormat string
+
+	Mailer       string
+	MailDir      string
+	MailFrom     string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	PasswordMinLength     int
+	PasswordMinClasses    int
+	PasswordHistory       int
+	BcryptCost            int
+	BreachedPasswordsFile string
+
+	TOTPTransferThreshold int64
+
+	Timeouts ServerTimeouts
+
+	// Feature toggles
+	RegistrationEnabled  bool
+	RequireVerifiedEmail bool
+
+	flags *flag.FlagSet
+}
+
+const (
+	defaultListenAddr = ":3000"
+	defaultConfigFile = ".env"
+)
+
+// secretSettings are printed redacted. DATABASE_URL is printed with its
+// password redacted.
+var secretSettings = map[string]bool{
+	"jwt-secret":     true,
+	"jwt-keys":       true,
+	"admin-password": true,
+	"smtp-password":  true,
+}
+
+func (c *Config) define(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen-addr", defaultListenAddr, "`address` the API listens on")
+	fs.StringVar(&c.Storage, "storage", "postgres", "storage backend: postgres, sqlite or memory")
+	fs.StringVar(&c.DatabaseURL, "database-url", "", "PostgreSQL connection string, required with -storage postgres")
+	fs.StringVar(&c.SQLitePath, "sqlite-path", "gobank.db", "SQLite database `file`")
+	fs.StringVar(&c.AppURL, "app-url", defaultAppURL, "`URL` of the frontend, used in links in emails")
+	c.CORSOrigins = []string{"*"}
+	fs.Var((*listValue)(&c.CORSOrigins), "cors-origins", "comma-separated `origins` allowed to call the API, or *")
+
+	fs.StringVar(&c.JWTSecret, "jwt-secret", "", "HS256 `secret` tokens are signed with")
+	fs.StringVar(&c.JWTKeys, "jwt-keys", "", "comma-separated kid=alg:value signing `keys`, instead of -jwt-secret")
+	fs.StringVar(&c.JWTSigningKey, "jwt-signing-key", "", "`kid` of the key new tokens are signed with (default the first)")
+
+	fs.StringVar(&c.AdminEmail, "admin-email", "", "`email` of the first admin, created at startup if no user has it")
+	fs.StringVar(&c.AdminPassword, "admin-password", "", "`password` of the first admin")
+
+	fs.StringVar(&c.LogLevel, "log-level", "info", "least severe `level` logged: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", "text", "log `format`: text or json")
+
+	fs.StringVar(&c.Mailer, "mailer", "log", "how emails are sent: log, file or smtp")
+	fs.StringVar(&c.MailDir, "mail-dir", "", "`directory` the file mailer writes to")
+	fs.StringVar(&c.MailFrom, "mail-from", "GoBank <no-reply@gobank.local>", "sender `address` of emails")
+	fs.StringVar(&c.SMTPHost, "smtp-host", "", "SMTP server `host`")
+	fs.StringVar(&c.SMTPPort, "smtp-port", "587", "SMTP server `port`")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", "", "SMTP `user name`")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", "", "SMTP `password`")
+
+	fs.IntVar(&c.PasswordMinLength, "password-min-length", defaultPasswordMinLength, "minimum password length")
+	fs.IntVar(&c.PasswordMinClasses, "password-min-classes", defaultPasswordMinClasses, "character classes a password must mix")
+	fs.IntVar(&c.PasswordHistory, "password-history", defaultPasswordHistory, "recent passwords that can't be reused")
+	fs.IntVar(&c.BcryptCost, "bcrypt-cost", defaultBcryptCost, "bcrypt `cost` of new password hashes")
+	fs.StringVar(&c.BreachedPasswordsFile, "breached-passwords-file", "", "`file` of SHA-1 hashes of breached passwords")
+
+	fs.Int64Var(&c.TOTPTransferThreshold, "totp-transfer-threshold", defaultTOTPTransferThreshold, "transfers above this `amount` need a two-factor code")
+
+	timeouts := defaultServerTimeouts()
+	fs.DurationVar(&c.Timeouts.ReadHeader, "read-header-timeout", timeouts.ReadHeader, "how long clients have to send request headers")
+	fs.DurationVar(&c.Timeouts.Read, "read-timeout", timeouts.Read, "how long clients have to send a whole request")
+	fs.DurationVar(&c.Timeouts.Write, "write-timeout", timeouts.Write, "how long a request may take to handle and answer")
+	fs.DurationVar(&c.Timeouts.Idle, "idle-timeout", timeouts.Idle, "how long idle keep-alive connections are kept open")
+	fs.DurationVar(&c.Timeouts.Shutdown, "shutdown-timeout", timeouts.Shutdown, "how long to wait for requests in flight when stopping")
+	fs.DurationVar(&c.Timeouts.DB, "db-timeout", timeouts.DB, "how long a request's database work may take")
+
+	fs.BoolVar(&c.RegistrationEnabled, "registration-enabled", true, "let anyone sign up through /register")
+	fs.BoolVar(&c.RequireVerifiedEmail, "require-verified-email", true, "only let users with a verified email make transfers")
+}
+
+// envName is the environment variable of a flag.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig reads and validates the configuration. args are the
+// command-line arguments without the program name; the arguments left
+// after the flags are returned.
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := new(Config)
+	fs := flag.NewFlagSet("gobank", flag.ContinueOnError)
+	configFile := fs.String("config", "", "config `file` of KEY=VALUE lines (default .env, if present)")
+	cfg.define(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gobank [flags] [migrate up|down|status]\n\nEvery flag can also be set with the environment variable of the same name,\nfor example -listen-addr with LISTEN_ADDR.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	cfg.flags = fs
+
+	setByFlag := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setByFlag[f.Name] = true })
+
+	file, err := readConfigFile(*configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setByFlag[f.Name] || f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			value, ok = file[name]
+		}
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readConfigFile reads the config file named by the -config flag or
+// CONFIG_FILE. Without either, .env is read if there is one.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		path = defaultConfigFile
+	}
+
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	return values, nil
+}
+
+// validate checks every setting, reporting all invalid ones at once. It
+// also normalizes APP_URL.
+func (c *Config) validate() error {
+	var errs []error
+	invalid := func(name string, value any, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %s", name, fmt.Sprint(value), fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("LISTEN_ADDR", c.ListenAddr, "must be host:port or :port")
+	}
+
+	switch c.Storage {
+	case "postgres":
+		if c.DatabaseURL == "" {
+			errs = append(errs, errors.New("STORAGE=postgres needs DATABASE_URL"))
+		}
+	case "sqlite":
+		if c.SQLitePath == "" {
+			errs = append(errs, errors.New("STORAGE=sqlite needs SQLITE_PATH"))
+		}
+	case "memory":
+	default:
+		invalid("STORAGE", c.Storage, "must be postgres, sqlite or memory")
+	}
+
+	c.AppURL = strings.TrimSuffix(c.AppURL, "/")
+	if u, err := url.Parse(c.AppURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("APP_URL", c.AppURL, "must be an http or https URL")
+	}
+
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			invalid("CORS_ORIGINS", origin, "origins must be * or scheme://host[:port]")
+		}
+	}
+
+	switch {
+	case c.AdminEmail != "":
+		v := new(validator)
+		v.email("ADMIN_EMAIL", normalizeEmail(c.AdminEmail))
+		for _, field := range v.fields {
+			errs = append(errs, errors.New(field.Message))
+		}
+		if c.AdminPassword == "" {
+			errs = append(errs, errors.New("ADMIN_PASSWORD is required with ADMIN_EMAIL"))
+		}
+	case c.AdminPassword != "":
+		errs = append(errs, errors.New("ADMIN_EMAIL is required with ADMIN_PASSWORD"))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("LOG_LEVEL", c.LogLevel, "must be debug, info, warn or error")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		invalid("LOG_FORMAT", c.LogFormat, "must be text or json")
+	}
+
+	switch c.Mailer {
+	case "log":
+	case "file":
+		if c.MailDir == "" {
+			errs = append(errs, errors.New("MAILER=file needs MAIL_DIR"))
+		}
+	case "smtp":
+		if c.SMTPHost == "" {
+			errs = append(errs, errors.New("MAILER=smtp needs SMTP_HOST"))
+		}
+		if port, err := strconv.Atoi(c.SMTPPort); err != nil || port < 1 || port > 65535 {
+			invalid("SMTP_PORT", c.SMTPPort, "must be a port number")
+		}
+	default:
+		invalid("MAILER", c.Mailer, "must be log, file or smtp")
+	}
+	if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+		invalid("MAIL_FROM", c.MailFrom, "must be an email address")
+	}
+
+	ranges := []struct {
+		name     string
+		value    int
+		min, max int
+	}{
+		{"PASSWORD_MIN_LENGTH", c.PasswordMinLength, 1, maxPasswordLength},
+		{"PASSWORD_MIN_CLASSES", c.PasswordMinClasses, 1, 4},
+		{"PASSWORD_HISTORY", c.PasswordHistory, 0, 100},
+		{"BCRYPT_COST", c.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost},
+	}
+	for _, r := range ranges {
+		if r.value < r.min || r.value > r.max {
+			invalid(r.name, r.value, "must be between %d and %d", r.min, r.max)
+		}
+	}
+
+	if c.TOTPTransferThreshold < 0 {
+		invalid("TOTP_TRANSFER_THRESHOLD", c.TOTPTransferThreshold, "must not be negative")
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", c.Timeouts.ReadHeader},
+		{"READ_TIMEOUT", c.Timeouts.Read},
+		{"WRITE_TIMEOUT", c.Timeouts.Write},
+		{"IDLE_TIMEOUT", c.Timeouts.Idle},
+		{"SHUTDOWN_TIMEOUT", c.Timeouts.Shutdown},
+		{"DB_TIMEOUT", c.Timeouts.DB},
+	}
+	for _, t := range timeouts {
+		if t.value <= 0 {
+			invalid(t.name, t.value, "must be a positive duration such as 30s")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// LogValue lists every setting under its environment variable name, with
+// secrets redacted.
+func (c *Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		switch {
+		case secretSettings[f.Name] && value != "":
+			value = redacted
+		case f.Name == "database-url":
+			value = redactDSN(value)
+		}
+		attrs = append(attrs, slog.String(envName(f.Name), value))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+// redactDSN hides the password in a PostgreSQL connection string, in
+// either its URL or its key=value form.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// listValue is a comma-separated flag.Value.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
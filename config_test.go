@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDatabaseURLHasNoDefault checks that no connection string, and so no
+// database password, is built in: Postgres needs DATABASE_URL to be set.
+func TestDatabaseURLHasNoDefault(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "empty.env")
+	if err := os.WriteFile(configFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DATABASE_URL", "")
+	os.Unsetenv("DATABASE_URL")
+	load := func(args ...string) error {
+		args = append([]string{"-config", configFile, "-jwt-secret", strings.Repeat("x", minSecretLength)}, args...)
+		_, _, err := loadConfig(args)
+		return err
+	}
+
+	err := load("-storage", "postgres")
+	if err == nil || !strings.Contains(err.Error(), "DATABASE_URL") {
+		t.Errorf("postgres without DATABASE_URL: got %v, want an error naming DATABASE_URL", err)
+	}
+	if err := load("-storage", "postgres", "-database-url", "postgres://gobank:secret@db:5432/gobank"); err != nil {
+		t.Errorf("postgres with DATABASE_URL: %v", err)
+	}
+	if err := load("-storage", "memory"); err != nil {
+		t.Errorf("memory store: %v", err)
+	}
+}
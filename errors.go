@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorKind classifies domain errors. The kind decides the HTTP status an
+// error is reported with.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindValidation
+	KindNotFound
+	KindUnauthorized
+	KindForbidden
+	KindConflict
+	KindInsufficientFunds
+	KindTooManyRequests
+	KindUnavailable
+)
+
+func (k ErrorKind) status() int {
+	switch k {
+	case KindValidation, KindInsufficientFunds:
+		return http.StatusUnprocessableEntity
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindConflict:
+		return http.StatusConflict
+	case KindTooManyRequests:
+		return http.StatusTooManyRequests
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is a domain error. Code is a stable, machine-readable identifier
+// that clients can branch on; Message is meant for people and may change.
+//
+// Two errors with the same code match under errors.Is, so callers add
+// context by wrapping a sentinel (fmt.Errorf("%w ...", ErrAccountNotFound))
+// or by building a new error with the same code.
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+
+	// Fields lists the invalid fields of a request that failed validation.
+	Fields []FieldError
+}
+
+func newError(kind ErrorKind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// validationError reports a malformed request with its own message.
+func validationError(format string, args ...any) error {
+	return newError(KindValidation, ErrInvalidRequest.Code, fmt.Sprintf(format, args...))
+}
+
+var (
+	ErrInternal = newError(KindInternal, "internal_error", "internal server error")
+
+	ErrInvalidRequest       = newError(KindValidation, "invalid_request", "invalid request")
+	ErrValidationFailed     = newError(KindValidation, "validation_failed", "some fields are invalid")
+	ErrInvalidAmount        = newError(KindValidation, "invalid_amount", "transfer amount must be positive")
+	ErrSelfTransfer         = newError(KindValidation, "self_transfer", "cannot transfer to the same account")
+	ErrNoRecipient          = newError(KindValidation, "missing_recipient", "transfer has no recipient")
+	ErrInvalidAccountNumber = newError(KindValidation, "invalid_account_number", "invalid account number")
+	ErrInvalidAccountType   = newError(KindValidation, "invalid_account_type", "invalid account type")
+	ErrIdempotencyKeyReused = newError(KindValidation, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+	ErrWeakPassword         = newError(KindValidation, "weak_password", "password is too weak")
+	ErrBreachedPassword     = newError(KindValidation, "breached_password", "this password has appeared in a data breach; choose another one")
+	ErrIncorrectPassword    = newError(KindValidation, "incorrect_password", "current password is incorrect")
+	ErrPasswordReused       = newError(KindValidation, "password_reused", "password was used recently")
+	ErrInvalidLink          = newError(KindValidation, "invalid_link", "the link is invalid, has expired or was already used")
+
+	ErrUserNotFound         = newError(KindNotFound, "user_not_found", "user not found")
+	ErrAccountNotFound      = newError(KindNotFound, "account_not_found", "account not found")
+	ErrUnknownRecipient     = newError(KindNotFound, "unknown_recipient", "recipient account not found")
+	ErrJournalEntryNotFound = newError(KindNotFound, "journal_entry_not_found", "journal entry not found")
+	ErrLockoutNotFound      = newError(KindNotFound, "lockout_not_found", "lockout not found")
+
+	ErrUnauthorized       = newError(KindUnauthorized, "unauthorized", "authentication required")
+	ErrInvalidToken       = newError(KindUnauthorized, "invalid_token", "invalid token")
+	ErrTokenRevoked       = newError(KindUnauthorized, "token_revoked", "token has been revoked")
+	ErrInvalidCredentials = newError(KindUnauthorized, "invalid_credentials", "invalid email or password")
+	ErrInvalidTOTPCode    = newError(KindUnauthorized, "invalid_totp_code", "invalid two-factor code")
+
+	ErrForbidden            = newError(KindForbidden, "forbidden", "you are not allowed to do this")
+	ErrTOTPRequired         = newError(KindForbidden, "totp_required", "a two-factor code is required")
+	ErrEmailNotVerified     = newError(KindForbidden, "email_not_verified", "verify your email address before sending transfers")
+	ErrRegistrationDisabled = newError(KindForbidden, "registration_disabled", "registration is disabled")
+	ErrSystemUser           = newError(KindForbidden, "system_user", "system users are managed through the server configuration")
+
+	ErrEmailTaken               = newError(KindConflict, "email_taken", "a user with this email already exists")
+	ErrAccountClosed            = newError(KindConflict, "account_closed", "account is closed")
+	ErrAccountNotEmpty          = newError(KindConflict, "account_not_empty", "account still has a balance")
+	ErrUserHasTransactions      = newError(KindConflict, "user_has_transactions", "user's accounts have transactions")
+	ErrTOTPAlreadyEnabled       = newError(KindConflict, "totp_already_enabled", "two-factor authentication is already enabled")
+	ErrTOTPNotEnabled           = newError(KindConflict, "totp_not_enabled", "two-factor authentication is not enabled")
+	ErrEmailAlreadyVerified     = newError(KindConflict, "email_already_verified", "email address is already verified")
+	ErrIdempotencyKeyInProgress = newError(KindConflict, "idempotency_key_in_progress", "a request with this Idempotency-Key is still being processed")
+	ErrInsufficientFunds        = newError(KindInsufficientFunds, "insufficient_funds", "insufficient funds")
+	ErrTooManyLoginAttempts     = newError(KindTooManyRequests, "too_many_login_attempts", "too many failed login attempts, try again later")
+
+	ErrTimeout         = newError(KindUnavailable, "timeout", "the request took too long, try again later")
+	ErrRequestCanceled = newError(KindUnavailable, "request_canceled", "the request was canceled")
+)
+
+// requestError reports an internal error that happened because r's context
+// ended, such as a database call cut off by DB_TIMEOUT, as ErrTimeout or
+// ErrRequestCanceled. Drivers don't always return the context's error, so
+// the context itself is checked.
+func requestError(r *http.Request, err error) error {
+	var domainErr *Error
+	if errors.As(err, &domainErr) && domainErr.Kind != KindInternal {
+		return err
+	}
+
+	switch ctxErr := r.Context().Err(); {
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		slog.Warn("request timed out", "method", r.Method, "err", err)
+		return ErrTimeout
+	case errors.Is(ctxErr, context.Canceled):
+		slog.Debug("request canceled by the client", "method", r.Method, "err", err)
+		return ErrRequestCanceled
+	}
+	return err
+}
+
+// writeError sends err as an ApiError. Errors that aren't domain errors are
+// logged and reported as a generic internal error, so database messages
+// never reach clients.
+func writeError(w http.ResponseWriter, err error) error {
+	var domainErr *Error
+	if !errors.As(err, &domainErr) || domainErr.Kind == KindInternal {
+		slog.Error("internal error", "err", err)
+		return WriteJSON(w, http.StatusInternalServerError, ApiError{Error: ErrInternal.Message, Code: ErrInternal.Code})
+	}
+
+	return WriteJSON(w, domainErr.Kind.status(), ApiError{Error: err.Error(), Code: domainErr.Code, Fields: domainErr.Fields})
+}
@@ -6,8 +6,14 @@ const AdminView: React.FC = () => {
   const navigate = useNavigate();
 
   useEffect(() => {
-    const adminEmail = 'admin@gmail.com'; // Monopoly Bank email
-    const adminPassword = 'megapassword'; // Monopoly Bank password
+    // Credentials of the admin the server creates from ADMIN_EMAIL and ADMIN_PASSWORD
+    const adminEmail = process.env.REACT_APP_ADMIN_EMAIL;
+    const adminPassword = process.env.REACT_APP_ADMIN_PASSWORD;
+
+    if (!adminEmail || !adminPassword) {
+      navigate('/login');
+      return;
+    }
 
     const performLogin = async () => {
       try {
@@ -38,7 +38,7 @@ const AvailableUsersCard: React.FC<{ currentUserId: number }> = ({ currentUserId
       </div>
       <div className="p-6">
         {users.length === 0 ? (
-          <p className="text-gray-600 italic">No other users available.</p>
+          <p className="text-gray-600 italic">No other users available. Only staff can list other users.</p>
         ) : (
           <div className="overflow-x-auto">
             <table className="w-full">
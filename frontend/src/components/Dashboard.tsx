@@ -4,7 +4,7 @@ import CurrentBalanceCard from './CurrentBalanceCard';
 import TransferFundsCard from './TransferFundsCard';
 import TransactionHistoryCard from './TransactionHistoryCard';
 import AvailableUsersCard from './AvailableUsersCard';
-import { getUserDetails } from '../services/api';
+import { getUserDetails, logoutUser } from '../services/api';
 import { LogOutIcon } from 'lucide-react';
 
 const Dashboard: React.FC = () => {
@@ -30,9 +30,12 @@ const Dashboard: React.FC = () => {
     fetchUserDetails();
   }, []);
 
-  const handleLogout = () => {
-    localStorage.removeItem('token');
-    localStorage.removeItem('userEmail');
+  const handleLogout = async () => {
+    try {
+      await logoutUser();
+    } catch (error) {
+      console.error('Error logging out:', error);
+    }
     navigate('/');
   };
 
@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from 'react';
-import { loginUser } from '../services/api';
+import { loginUser, loginWithTOTP } from '../services/api';
 import { Mail, Lock } from 'lucide-react';
 import { useNavigate, Link } from 'react-router-dom';
 import axios from 'axios';
@@ -8,6 +8,8 @@ const Login: React.FC = () => {
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
   const [error, setError] = useState('');
+  const [mfaToken, setMfaToken] = useState('');
+  const [code, setCode] = useState('');
   const navigate = useNavigate();
 
   useEffect(() => {
@@ -21,13 +23,19 @@ const Login: React.FC = () => {
     e.preventDefault();
     setError('');
     try {
-      const response = await loginUser(email, password);
+      const response = mfaToken
+        ? await loginWithTOTP(mfaToken, code)
+        : await loginUser(email, password);
+      if (response.data.mfaRequired) {
+        setMfaToken(response.data.mfaToken);
+        return;
+      }
       localStorage.setItem('token', response.data.token);
       localStorage.setItem('userId', response.data.user.id.toString());
       navigate('/dashboard');
     } catch (error) {
       if (axios.isAxiosError(error) && error.response) {
-        if (error.response.status === 400) {
+        if ([400, 401, 429].includes(error.response.status)) {
           setError(error.response.data.Error || 'Invalid email or password');
         } else {
           setError('An error occurred. Please try again.');
@@ -91,6 +99,34 @@ const Login: React.FC = () => {
             </div>
           </div>
 
+          {mfaToken && (
+            <div>
+              <label htmlFor="totp-code" className="sr-only">
+                Authenticator code
+              </label>
+              <input
+                id="totp-code"
+                name="code"
+                type="text"
+                inputMode="numeric"
+                autoComplete="one-time-code"
+                required
+                className="appearance-none rounded-md relative block w-full px-3 py-2 border border-gray-300 placeholder-gray-500 text-gray-900 focus:outline-none focus:ring-indigo-500 focus:border-indigo-500 sm:text-sm"
+                placeholder="6-digit code from your authenticator app"
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+              />
+            </div>
+          )}
+
+          {error && <p className="text-sm text-red-600">{error}</p>}
+
+          <div className="text-sm text-right">
+            <Link to="/reset-password" className="font-medium text-indigo-600 hover:text-indigo-500">
+              Forgot your password?
+            </Link>
+          </div>
+
           <div>
             <button
               type="submit"
@@ -2,16 +2,19 @@ import React, { useState } from 'react';
 import { createUser } from '../services/api';
 import { User, Mail, Lock } from 'lucide-react';
 import { useNavigate, Link } from 'react-router-dom';
+import axios from 'axios';
 
 const Register: React.FC = () => {
   const [firstName, setFirstName] = useState('');
   const [lastName, setLastName] = useState('');
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
+  const [error, setError] = useState('');
   const navigate = useNavigate();
 
   const handleRegister = async (e: React.FormEvent<HTMLFormElement>) => {
     e.preventDefault();
+    setError('');
     console.log('Register form submitted', { firstName, lastName, email, password });
     try {
       console.log('Calling createUser API');
@@ -21,6 +24,12 @@ const Register: React.FC = () => {
       localStorage.setItem('userId', response.data.user.id.toString());
       navigate('/dashboard');
     } catch (error) {
+      if (axios.isAxiosError(error) && error.response) {
+        const { Error: message, fields } = error.response.data;
+        setError(fields ? fields.map((f: { message: string }) => f.message).join('. ') : message);
+      } else {
+        setError('An unexpected error occurred. Please try again.');
+      }
       console.error('Registration failed:', error);
     }
   };
@@ -117,6 +126,8 @@ const Register: React.FC = () => {
             </div>
           </div>
 
+          {error && <p className="text-sm text-red-600">{error}</p>}
+
           <div>
             <button
               type="submit"
@@ -0,0 +1,73 @@
+import React, { useState } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import axios from 'axios';
+import { requestPasswordReset, resetPassword } from '../services/api';
+
+// ResetPassword asks for an email address to send a reset link to, or, when
+// opened from that link, for the new password.
+const ResetPassword: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token');
+  const [value, setValue] = useState('');
+  const [message, setMessage] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (e: React.FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    setError('');
+    try {
+      if (token) {
+        await resetPassword(token, value);
+        setMessage('Your password has been changed. You can now sign in with it.');
+      } else {
+        await requestPasswordReset(value);
+        setMessage('If an account uses this email address, we have sent it a link to reset the password.');
+      }
+    } catch (err) {
+      if (axios.isAxiosError(err) && err.response) {
+        setError(err.response.data.Error);
+      } else {
+        setError('An unexpected error occurred. Please try again.');
+      }
+    }
+  };
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-8">
+        <h2 className="mt-6 text-center text-3xl font-extrabold text-gray-900">
+          {token ? 'Choose a new password' : 'Reset your password'}
+        </h2>
+        {message ? (
+          <p className="text-center text-gray-600">{message}</p>
+        ) : (
+          <form className="mt-8 space-y-6" onSubmit={handleSubmit}>
+            <input
+              type={token ? 'password' : 'email'}
+              autoComplete={token ? 'new-password' : 'email'}
+              required
+              className="appearance-none rounded-md relative block w-full px-3 py-2 border border-gray-300 placeholder-gray-500 text-gray-900 focus:outline-none focus:ring-indigo-500 focus:border-indigo-500 sm:text-sm"
+              placeholder={token ? 'New password' : 'Email address'}
+              value={value}
+              onChange={(e) => setValue(e.target.value)}
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+            <button
+              type="submit"
+              className="group relative w-full flex justify-center py-2 px-4 border border-transparent text-sm font-medium rounded-md text-white bg-indigo-600 hover:bg-indigo-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-indigo-500"
+            >
+              {token ? 'Change password' : 'Send reset link'}
+            </button>
+          </form>
+        )}
+        <div className="text-center">
+          <Link to="/login" className="font-medium text-indigo-600 hover:text-indigo-500">
+            Back to sign in
+          </Link>
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default ResetPassword;
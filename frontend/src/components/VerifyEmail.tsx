@@ -0,0 +1,40 @@
+import React, { useEffect, useState } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import axios from 'axios';
+import { verifyEmail } from '../services/api';
+
+const VerifyEmail: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const [status, setStatus] = useState<'pending' | 'verified' | 'failed'>('pending');
+  const [error, setError] = useState('');
+
+  useEffect(() => {
+    const token = searchParams.get('token') || '';
+    verifyEmail(token)
+      .then(() => setStatus('verified'))
+      .catch((err) => {
+        setStatus('failed');
+        if (axios.isAxiosError(err) && err.response) {
+          setError(err.response.data.Error);
+        } else {
+          setError('An unexpected error occurred. Please try again.');
+        }
+      });
+  }, [searchParams]);
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 py-12 px-4 sm:px-6 lg:px-8">
+      <div className="max-w-md w-full space-y-6 text-center">
+        <h2 className="text-3xl font-extrabold text-gray-900">Email verification</h2>
+        {status === 'pending' && <p className="text-gray-600">Verifying your email address...</p>}
+        {status === 'verified' && <p className="text-gray-600">Your email address is verified. You can now send transfers.</p>}
+        {status === 'failed' && <p className="text-sm text-red-600">{error}</p>}
+        <Link to="/login" className="font-medium text-indigo-600 hover:text-indigo-500">
+          Go to sign in
+        </Link>
+      </div>
+    </div>
+  );
+};
+
+export default VerifyEmail;
@@ -3,6 +3,48 @@ import axios from 'axios';
 
 const API_URL = 'http://localhost:3000/'; // Ensure this matches your backend
 
+// Every endpoint except register and login needs the token from loginUser.
+axios.interceptors.request.use((config) => {
+  const token = localStorage.getItem('token');
+  if (token && !config.headers.Authorization) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
+// Access tokens expire after a few minutes. When a request fails with an
+// expired token, trade the refresh token for a new pair and retry it once.
+axios.interceptors.response.use(undefined, async (error) => {
+  const { config, response } = error;
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (!response || response.status !== 401 || response.data?.code !== 'invalid_token'
+      || !refreshToken || config._retried) {
+    throw error;
+  }
+
+  config._retried = true;
+  const refreshed = await axios.post(`${API_URL}token/refresh`, { refreshToken }, { _retried: true });
+  storeSession(refreshed.data);
+  config.headers.Authorization = `Bearer ${refreshed.data.token}`;
+  return axios(config);
+});
+
+const storeSession = (data) => {
+  localStorage.setItem('token', data.token);
+  localStorage.setItem('refreshToken', data.refreshToken);
+  localStorage.setItem('userEmail', data.user.email);
+};
+
+export const logoutUser = async () => {
+  try {
+    await axios.post(`${API_URL}logout`);
+  } finally {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    localStorage.removeItem('userEmail');
+  }
+};
+
 export const getUsers = () => {
   return axios.get(`${API_URL}account`);
 };
@@ -11,7 +53,7 @@ export const createUser = async (firstName, lastName, email, password) => {
     console.log('createUser called with:', { firstName, lastName, email, password });
     try {
       const response = await axios.post(`${API_URL}register`, { firstName, lastName, email, password });
-      localStorage.setItem('userEmail', response.data.user.email);
+      storeSession(response.data);
       console.log("Email stored in local storage: ", response.data.user.email);
       console.log('createUser response:', response);
       return response;
@@ -21,12 +63,15 @@ export const createUser = async (firstName, lastName, email, password) => {
     }
   };
 
-  export const transferFunds = (fromId, toId, amount) => {
+  // Pass the same idempotencyKey when retrying a transfer so the server
+  // doesn't move the money twice.
+  export const transferFunds = (fromId, toId, amount, idempotencyKey = crypto.randomUUID()) => {
     const token = localStorage.getItem('token');
     return axios.post(`${API_URL}transfer`, { toId, amount }, {
         headers: {
             'Authorization': `Bearer ${token}`,
-            'Content-Type': 'application/json'
+            'Content-Type': 'application/json',
+            'Idempotency-Key': idempotencyKey
         }
     });
 };
@@ -35,12 +80,13 @@ export const deleteUser = (id) => {
     return axios.delete(`${API_URL}account${id}`);
 };
 
+// loginUser resolves with either a session or, for users with two-factor
+// authentication, { mfaRequired: true, mfaToken } to pass to loginWithTOTP.
 export const loginUser = async (email, password) => {
   try {
     const response = await axios.post(`${API_URL}login`, { email, password });
     if (response.data.token) {
-      localStorage.setItem('token', response.data.token);
-      localStorage.setItem('userEmail', response.data.user.email);
+      storeSession(response.data);
       console.log("Email stored in local storage: ", response.data.user.email);
     }
     return response;
@@ -52,6 +98,28 @@ export const loginUser = async (email, password) => {
 
 
 
+export const loginWithTOTP = async (mfaToken, code) => {
+  const response = await axios.post(`${API_URL}login/totp`, { mfaToken, code });
+  storeSession(response.data);
+  return response;
+};
+
+export const verifyEmail = (token) => {
+  return axios.post(`${API_URL}verify-email`, { token });
+};
+
+export const resendVerificationEmail = () => {
+  return axios.post(`${API_URL}me/verification-email`);
+};
+
+export const requestPasswordReset = (email) => {
+  return axios.post(`${API_URL}password-reset`, { email });
+};
+
+export const resetPassword = (token, password) => {
+  return axios.post(`${API_URL}password-reset/confirm`, { token, password });
+};
+
 export const getUserIdByEmail = async (email) => {
   try {
     const response = await axios.get(`${API_URL}user-by-email/${email}`);
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Clients can send an Idempotency-Key header with mutating requests so that
+// retries are safe: the first request with a key runs normally and its
+// response is stored, and any later request with the same key gets that
+// response back without the handler running again.
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+
+	idempotencyKeyMaxLength = 255
+
+	// idempotencyKeyTTL is how long a key is remembered. Afterwards it can
+	// be reused for a new request.
+	idempotencyKeyTTL = 24 * time.Hour
+)
+
+// IdempotencyRecord is a stored Idempotency-Key. Keys are scoped to the user
+// that sent them (UserID 0 for requests without a token). A StatusCode of 0
+// means the first request with the key is still running.
+type IdempotencyRecord struct {
+	UserID      int
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+func (r *IdempotencyRecord) pending() bool {
+	return r.StatusCode == 0
+}
+
+// requestFingerprint identifies a request by its method, path and body, so a
+// key that is reused for a different request can be told apart from a retry.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder passes a response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a mutating handler with Idempotency-Key support. Requests
+// without the header are passed straight through. Server errors are not
+// stored, so a request that failed with a 5xx can be retried with the same key.
+func (s *APIServer) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			writeError(w, validationError("%s must be at most %d characters", idempotencyKeyHeader, idempotencyKeyMaxLength))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, validationError("reading request body: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		record := &IdempotencyRecord{
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+			CreatedAt:   time.Now().UTC(),
+		}
+		if user := currentUser(r); user != nil {
+			record.UserID = user.ID
+		}
+
+		existing, err := s.store.ReserveIdempotencyKey(r.Context(), record)
+		if err != nil {
+			writeError(w, requestError(r, fmt.Errorf("reserving idempotency key: %w", err)))
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != record.Fingerprint:
+				writeError(w, ErrIdempotencyKeyReused)
+			case existing.pending():
+				writeError(w, ErrIdempotencyKeyInProgress)
+			default:
+				slog.Debug("replaying idempotent response", "user_id", record.UserID, "idempotency_key", key)
+				w.Header().Set(idempotentReplayHeader, "true")
+				if len(existing.Body) > 0 {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// The request may have timed out or the client gone away, but the key
+		// must still be released or completed
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.timeouts.DB)
+		defer cancel()
+
+		if rec.status == 0 || rec.status >= 500 {
+			if err := s.store.DeleteIdempotencyKey(ctx, record.UserID, record.Key); err != nil {
+				slog.Error("releasing idempotency key failed", "user_id", record.UserID, "err", err)
+			}
+			return
+		}
+
+		record.StatusCode = rec.status
+		record.Body = rec.body.Bytes()
+		if err := s.store.CompleteIdempotencyKey(ctx, record); err != nil {
+			slog.Error("storing idempotent response failed", "user_id", record.UserID, "err", err)
+		}
+	}
+}
+
+// reserveIdempotencyKey is the shared SQL implementation of
+// Storage.ReserveIdempotencyKey.
+func reserveIdempotencyKey(ctx context.Context, db *sql.DB, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, record.CreatedAt.Add(-idempotencyKeyTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := db.ExecContext(ctx, `INSERT INTO idempotency_keys (user_id, idempotency_key, fingerprint, created_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, idempotency_key) DO NOTHING`,
+		record.UserID, record.Key, record.Fingerprint, record.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted == 1 {
+		return nil, nil
+	}
+
+	existing := &IdempotencyRecord{}
+	var body string
+	err = db.QueryRowContext(ctx, `SELECT user_id, idempotency_key, fingerprint, status_code, response_body, created_at
+		FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2`, record.UserID, record.Key).
+		Scan(&existing.UserID, &existing.Key, &existing.Fingerprint, &existing.StatusCode, &body, &existing.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	existing.Body = []byte(body)
+
+	return existing, nil
+}
+
+// completeIdempotencyKey stores the response of the request that reserved
+// the key.
+func completeIdempotencyKey(ctx context.Context, db *sql.DB, record *IdempotencyRecord) error {
+	_, err := db.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = $1, response_body = $2
+		WHERE user_id = $3 AND idempotency_key = $4`,
+		record.StatusCode, string(record.Body), record.UserID, record.Key)
+	return err
+}
+
+func deleteIdempotencyKey(ctx context.Context, db *sql.DB, userID int, key string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2`, userID, key)
+	return err
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with one key and verified with any key in the set, so a
+// key can be rotated by adding the new key, making it the signing key and
+// removing the old one once the tokens it signed have expired. Tokens name
+// their key in the kid header.
+//
+// Keys come from the configuration:
+//
+//	JWT_SECRET       a single HS256 secret, used when JWT_KEYS is empty
+//	JWT_KEYS         comma-separated kid=alg:value entries, where value is
+//	                 the secret for HS256 and the path to a PEM private key
+//	                 for RS256 and EdDSA
+//	JWT_SIGNING_KEY  the kid of the key to sign with; defaults to the first
+//	                 key in JWT_KEYS
+const (
+	defaultKeyID = "default"
+
+	// minSecretLength is the shortest HS256 secret accepted: 256 bits.
+	minSecretLength = 32
+)
+
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private any
+	Public  any
+}
+
+// KeySet holds the keys tokens are signed and verified with.
+type KeySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+// loadKeySet parses the configured keys. It fails if there are none, so
+// the server never signs tokens with an empty key.
+func loadKeySet(cfg *Config) (*KeySet, error) {
+	keySet := &KeySet{keys: map[string]*signingKey{}}
+
+	entries := cfg.JWTKeys
+	if entries == "" {
+		secret := cfg.JWTSecret
+		if secret == "" {
+			return nil, errors.New("no JWT signing key configured: set JWT_SECRET or JWT_KEYS")
+		}
+		entries = defaultKeyID + "=HS256:" + secret
+	}
+
+	for _, entry := range strings.Split(entries, ",") {
+		key, err := parseSigningKey(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keySet.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate JWT key ID %q", key.ID)
+		}
+		keySet.keys[key.ID] = key
+		if keySet.signing == nil {
+			keySet.signing = key
+		}
+	}
+
+	if kid := cfg.JWTSigningKey; kid != "" {
+		key, ok := keySet.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY %q is not in JWT_KEYS", kid)
+		}
+		keySet.signing = key
+	}
+
+	return keySet, nil
+}
+
+// parseSigningKey parses one kid=alg:value entry of JWT_KEYS.
+func parseSigningKey(entry string) (*signingKey, error) {
+	kid, rest, ok := strings.Cut(entry, "=")
+	if !ok || kid == "" {
+		return nil, fmt.Errorf("invalid JWT key %q: expected kid=alg:value", entry)
+	}
+	alg, value, ok := strings.Cut(rest, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid JWT key %q: expected kid=alg:value", kid)
+	}
+
+	key := &signingKey{ID: kid}
+	switch alg {
+	case "HS256":
+		if len(value) < minSecretLength {
+			return nil, fmt.Errorf("JWT key %q: HS256 secrets must be at least %d bytes", kid, minSecretLength)
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.Private = []byte(value)
+		key.Public = []byte(value)
+	case "RS256", "EdDSA":
+		private, err := readPrivateKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q: %w", kid, err)
+		}
+		switch private := private.(type) {
+		case *rsa.PrivateKey:
+			if alg != "RS256" {
+				return nil, fmt.Errorf("JWT key %q: %s is an RSA key, not %s", kid, value, alg)
+			}
+			key.Method = jwt.SigningMethodRS256
+			key.Private = private
+			key.Public = &private.PublicKey
+		case ed25519.PrivateKey:
+			if alg != "EdDSA" {
+				return nil, fmt.Errorf("JWT key %q: %s is an Ed25519 key, not %s", kid, value, alg)
+			}
+			key.Method = jwt.SigningMethodEdDSA
+			key.Private = private
+			key.Public = private.Public()
+		default:
+			return nil, fmt.Errorf("JWT key %q: unsupported key type %T", kid, private)
+		}
+	default:
+		return nil, fmt.Errorf("JWT key %q: unsupported algorithm %q", kid, alg)
+	}
+
+	return key, nil
+}
+
+// readPrivateKey reads a PKCS#8 (or, for RSA, PKCS#1) PEM private key.
+func readPrivateKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// sign signs claims with the signing key and names it in the kid header.
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	token.Header["kid"] = k.signing.ID
+	return token.SignedString(k.signing.Private)
+}
+
+// keyFunc picks the verification key named by the token's kid. The token's
+// alg must match the key's, so a public key can't be used as an HMAC secret.
+func (k *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwks returns the public keys of the asymmetric keys in the set. HS256
+// secrets are never published, so services can only verify tokens
+// themselves when gobank signs with RS256 or EdDSA.
+func (k *KeySet) jwks() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{KeyID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
+
+// GET /.well-known/jwks.json publishes the public keys tokens can be
+// verified with.
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.keys.jwks())
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Money only moves through journal entries. Every entry has postings that
+// sum to zero, and every account balance is the sum of its postings, so the
+// sum of all balances (including the mint's negative one) is always zero.
+const (
+	EntryTransfer = "transfer"
+	EntryOpening  = "opening"
+
+	// EntryAdjustment is a manual credit or debit by bank staff.
+	EntryAdjustment = "adjustment"
+
+	// mintSystemKey names the system account that funds opening balances.
+	// Its balance is the negative of all money ever issued.
+	mintSystemKey = "mint"
+)
+
+type JournalEntry struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Postings    []Posting `json:"postings"`
+}
+
+// Posting is one side of a journal entry. A positive amount increases the
+// account's balance and a negative amount decreases it.
+type Posting struct {
+	ID        int       `json:"id"`
+	EntryID   int       `json:"entryId"`
+	AccountID int       `json:"accountId"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// LedgerReport is the result of reconciling account balances against the
+// postings that produced them.
+type LedgerReport struct {
+	Balanced          bool                    `json:"balanced"`
+	PostingsTotal     int64                   `json:"postingsTotal"`
+	UnbalancedEntries []int                   `json:"unbalancedEntries"`
+	Discrepancies     []AccountReconciliation `json:"discrepancies"`
+}
+
+// AccountReconciliation reports an account whose stored balance differs
+// from the sum of its postings.
+type AccountReconciliation struct {
+	AccountID     int   `json:"accountId"`
+	Balance       int64 `json:"balance"`
+	LedgerBalance int64 `json:"ledgerBalance"`
+}
+
+func (r *LedgerReport) check() {
+	r.Balanced = r.PostingsTotal == 0 && len(r.UnbalancedEntries) == 0 && len(r.Discrepancies) == 0
+}
+
+// transactionType describes a posting from the account holder's side.
+func transactionType(kind string, amount int64) string {
+	switch {
+	case kind == EntryOpening:
+		return "Opening balance"
+	case kind == EntryAdjustment:
+		return "Adjustment"
+	case amount < 0:
+		return "Sent"
+	default:
+		return "Received"
+	}
+}
+
+// postJournalEntry records a balanced entry and applies its postings to the
+// account balances. It is shared by the SQL stores and must run inside tx.
+func postJournalEntry(ctx context.Context, tx *sql.Tx, kind, description string, postings []Posting) (int, error) {
+	var total int64
+	for _, p := range postings {
+		total += p.Amount
+	}
+	if total != 0 {
+		return 0, fmt.Errorf("journal entry is unbalanced by %d", total)
+	}
+
+	now := time.Now().UTC()
+
+	var entryID int
+	err := tx.QueryRowContext(ctx, `INSERT INTO journal_entries (kind, description, created_at) VALUES ($1, $2, $3) RETURNING id`,
+		kind, description, now).Scan(&entryID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range postings {
+		_, err := tx.ExecContext(ctx, `INSERT INTO postings (entry_id, account_id, amount, created_at) VALUES ($1, $2, $3, $4)`,
+			entryID, p.AccountID, p.Amount, now)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = balance + $1 WHERE id = $2`, p.Amount, p.AccountID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return entryID, nil
+}
+
+// postOpeningBalance funds a new account from the mint. It must run inside tx.
+func postOpeningBalance(ctx context.Context, tx *sql.Tx, accountID int, amount int64) error {
+	return postAgainstMint(ctx, tx, EntryOpening, fmt.Sprintf("opening balance for account %d", accountID), accountID, amount)
+}
+
+// postAdjustment credits or debits an account against the mint. The caller
+// checks the account first. It must run inside tx.
+func postAdjustment(ctx context.Context, tx *sql.Tx, accountID int, amount int64, description string) error {
+	return postAgainstMint(ctx, tx, EntryAdjustment, description, accountID, amount)
+}
+
+func postAgainstMint(ctx context.Context, tx *sql.Tx, kind, description string, accountID int, amount int64) error {
+	var mintID int
+	err := tx.QueryRowContext(ctx, `SELECT id FROM accounts WHERE system_key = $1`, mintSystemKey).Scan(&mintID)
+	if err != nil {
+		return fmt.Errorf("finding mint account: %w", err)
+	}
+
+	_, err = postJournalEntry(ctx, tx, kind, description, []Posting{
+		{AccountID: mintID, Amount: -amount},
+		{AccountID: accountID, Amount: amount},
+	})
+	return err
+}
+
+// queryTransactions returns an account's postings as customer transactions.
+func queryTransactions(ctx context.Context, db *sql.DB, accountID int) ([]Transaction, error) {
+	rows, err := db.QueryContext(ctx, `SELECT p.id, p.account_id, p.entry_id, p.amount, j.kind, p.created_at
+		FROM postings p JOIN journal_entries j ON j.id = p.entry_id
+		WHERE p.account_id = $1 ORDER BY p.id ASC`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []Transaction
+	for rows.Next() {
+		var t Transaction
+		var kind string
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.EntryID, &t.Amount, &kind, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Type = transactionType(kind, t.Amount)
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// queryJournalEntries returns up to limit entries with an ID greater than
+// afterID, oldest first, each with its postings.
+func queryJournalEntries(ctx context.Context, db *sql.DB, afterID, limit int) ([]*JournalEntry, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, kind, description, created_at FROM journal_entries
+		WHERE id > $1 ORDER BY id ASC LIMIT $2`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*JournalEntry{}
+	byID := map[int]*JournalEntry{}
+	for rows.Next() {
+		entry := &JournalEntry{Postings: []Posting{}}
+		if err := rows.Scan(&entry.ID, &entry.Kind, &entry.Description, &entry.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+		byID[entry.ID] = entry
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT id, entry_id, account_id, amount, created_at FROM postings
+		WHERE entry_id >= $1 AND entry_id <= $2 ORDER BY id ASC`, entries[0].ID, entries[len(entries)-1].ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.ID, &p.EntryID, &p.AccountID, &p.Amount, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		if entry, ok := byID[p.EntryID]; ok {
+			entry.Postings = append(entry.Postings, p)
+		}
+	}
+	return entries, rows.Err()
+}
+
+// reconcileLedger checks that postings balance and that every stored
+// account balance matches the sum of its postings.
+func reconcileLedger(ctx context.Context, db *sql.DB) (*LedgerReport, error) {
+	report := &LedgerReport{
+		UnbalancedEntries: []int{},
+		Discrepancies:     []AccountReconciliation{},
+	}
+
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM postings`).Scan(&report.PostingsTotal); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT entry_id FROM postings GROUP BY entry_id HAVING SUM(amount) <> 0 ORDER BY entry_id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT a.id, a.balance, COALESCE(SUM(p.amount), 0)
+		FROM accounts a LEFT JOIN postings p ON p.account_id = a.id
+		GROUP BY a.id, a.balance
+		HAVING a.balance <> COALESCE(SUM(p.amount), 0)
+		ORDER BY a.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r AccountReconciliation
+		if err := rows.Scan(&r.AccountID, &r.Balance, &r.LedgerBalance); err != nil {
+			return nil, err
+		}
+		report.Discrepancies = append(report.Discrepancies, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report.check()
+	return report, nil
+}
+
+// migrateTransactionsToLedger turns the legacy transactions rows into
+// journal entries and posts opening balances for money that never went
+// through a transfer, so existing balances reconcile against the ledger.
+// Rows written by the same transfer share a timestamp and are grouped into
+// one entry; any residue is booked against the mint.
+func migrateTransactionsToLedger(tx *sql.Tx) error {
+	var mintID int
+	if err := tx.QueryRow(`SELECT id FROM accounts WHERE system_key = $1`, mintSystemKey).Scan(&mintID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT account_id, amount, created_at FROM transactions ORDER BY id ASC`)
+	if err != nil {
+		return err
+	}
+
+	type group struct {
+		createdAt time.Time
+		postings  []Posting
+	}
+	var groups []*group
+	byTime := map[int64]*group{}
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.AccountID, &p.Amount, &p.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		g, ok := byTime[p.CreatedAt.UnixNano()]
+		if !ok {
+			g = &group{createdAt: p.CreatedAt}
+			byTime[p.CreatedAt.UnixNano()] = g
+			groups = append(groups, g)
+		}
+		g.postings = append(g.postings, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	insertEntry := func(kind, description string, createdAt time.Time, postings []Posting) error {
+		var total int64
+		for _, p := range postings {
+			total += p.Amount
+		}
+		if total != 0 {
+			postings = append(postings, Posting{AccountID: mintID, Amount: -total})
+		}
+
+		var entryID int
+		err := tx.QueryRow(`INSERT INTO journal_entries (kind, description, created_at) VALUES ($1, $2, $3) RETURNING id`,
+			kind, description, createdAt).Scan(&entryID)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range postings {
+			_, err := tx.Exec(`INSERT INTO postings (entry_id, account_id, amount, created_at) VALUES ($1, $2, $3, $4)`,
+				entryID, p.AccountID, p.Amount, createdAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, g := range groups {
+		if err := insertEntry(EntryTransfer, "migrated transfer", g.createdAt, g.postings); err != nil {
+			return err
+		}
+	}
+
+	// whatever part of a balance the postings don't explain was an opening balance
+	rows, err = tx.Query(`SELECT a.id, a.balance - COALESCE(SUM(p.amount), 0)
+		FROM accounts a LEFT JOIN postings p ON p.account_id = a.id
+		WHERE a.system_key IS NULL
+		GROUP BY a.id, a.balance
+		HAVING a.balance <> COALESCE(SUM(p.amount), 0)
+		ORDER BY a.id`)
+	if err != nil {
+		return err
+	}
+
+	var opening []Posting
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.AccountID, &p.Amount); err != nil {
+			rows.Close()
+			return err
+		}
+		opening = append(opening, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(opening) > 0 {
+		if err := insertEntry(EntryOpening, "opening balances migrated from accounts", time.Now().UTC(), opening); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE accounts SET balance = (SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account_id = $1) WHERE id = $1`, mintID)
+	return err
+}
+
+// GET /ledger/entries?after={id}&limit={n}
+func (s *APIServer) handleGetJournalEntries(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePermission(r, PermViewLedger); err != nil {
+		return err
+	}
+
+	afterID := 0
+	if after := r.URL.Query().Get("after"); after != "" {
+		id, err := strconv.Atoi(after)
+		if err != nil {
+			return validationError("invalid after: %s", after)
+		}
+		afterID = id
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 1000 {
+			return validationError("invalid limit: %s", l)
+		}
+		limit = n
+	}
+
+	entries, err := s.store.GetJournalEntries(r.Context(), afterID, limit)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entries)
+}
+
+// GET /ledger/entries/{id}
+func (s *APIServer) handleGetJournalEntry(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePermission(r, PermViewLedger); err != nil {
+		return err
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid journal entry ID: %s", idStr)
+	}
+
+	entries, err := s.store.GetJournalEntries(r.Context(), id-1, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 || entries[0].ID != id {
+		return fmt.Errorf("%w with ID: %d", ErrJournalEntryNotFound, id)
+	}
+
+	return WriteJSON(w, http.StatusOK, entries[0])
+}
+
+// GET /ledger/reconciliation
+func (s *APIServer) handleReconcileLedger(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePermission(r, PermViewLedger); err != nil {
+		return err
+	}
+
+	report, err := s.store.ReconcileLedger(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, report)
+}
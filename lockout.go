@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Failed logins are counted per account (by email address, whether or not
+// a user has it, so lockouts don't reveal which addresses exist) and per
+// client IP. After a few failures each further one makes the next attempt
+// wait, doubling every time, and enough failures lock the login out for a
+// while. Lockouts are recorded so admins can review and lift them. Counts
+// are forgotten an hour after the last failure, or on a successful login.
+const (
+	ScopeAccount = "account"
+	ScopeIP      = "ip"
+
+	loginFailureWindow = time.Hour
+)
+
+// loginPolicy says how failures for one scope are throttled.
+type loginPolicy struct {
+	// FreeAttempts failures are allowed without delay. Each later failure
+	// delays the next attempt, starting at BaseDelay and doubling.
+	FreeAttempts int
+	BaseDelay    time.Duration
+	// LockoutAfter failures lock the login for LockoutDuration and record
+	// a Lockout.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+}
+
+var loginPolicies = map[string]loginPolicy{
+	ScopeAccount: {FreeAttempts: 3, BaseDelay: time.Second, LockoutAfter: 10, LockoutDuration: 15 * time.Minute},
+	// Many users can share an IP, so it is allowed more.
+	ScopeIP: {FreeAttempts: 20, BaseDelay: time.Second, LockoutAfter: 100, LockoutDuration: 15 * time.Minute},
+}
+
+// delay returns how long to wait after the given number of failures, and
+// whether that is a lockout.
+func (p loginPolicy) delay(failures int) (time.Duration, bool) {
+	if failures >= p.LockoutAfter {
+		return p.LockoutDuration, true
+	}
+	if failures <= p.FreeAttempts {
+		return 0, false
+	}
+	delay := p.BaseDelay << (failures - p.FreeAttempts - 1)
+	if delay <= 0 || delay > p.LockoutDuration {
+		delay = p.LockoutDuration
+	}
+	return delay, false
+}
+
+// LoginAttempts counts the recent failed logins for an account or IP.
+type LoginAttempts struct {
+	Scope         string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// Lockout records that logins for an account or IP were locked.
+type Lockout struct {
+	ID          int        `json:"id"`
+	Scope       string     `json:"scope"`
+	Subject     string     `json:"subject"`
+	UserID      int        `json:"userId,omitempty"`
+	Failures    int        `json:"failures"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LockedUntil time.Time  `json:"lockedUntil"`
+	UnlockedAt  *time.Time `json:"unlockedAt,omitempty"`
+	UnlockedBy  int        `json:"unlockedBy,omitempty"`
+}
+
+// clientIP returns the IP the request came from. X-Forwarded-For is not
+// trusted, since clients can set it to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLoginAllowed rejects a login attempt while the account or IP has to
+// wait, setting Retry-After to the seconds left.
+func (s *APIServer) checkLoginAllowed(ctx context.Context, w http.ResponseWriter, email, ip string) error {
+	now := s.now()
+	for _, key := range [][2]string{{ScopeAccount, email}, {ScopeIP, ip}} {
+		attempts, err := s.store.GetLoginAttempts(ctx, key[0], key[1])
+		if err != nil {
+			return err
+		}
+		if attempts == nil || attempts.LockedUntil == nil || !attempts.LockedUntil.After(now) {
+			continue
+		}
+
+		wait := attempts.LockedUntil.Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return ErrTooManyLoginAttempts
+	}
+	return nil
+}
+
+// loginFailed counts a failed login for the account and IP, applying the
+// backoff and recording lockouts. user is nil if no user has the email.
+func (s *APIServer) loginFailed(ctx context.Context, email, ip string, user *User) error {
+	now := s.now().UTC()
+	for _, key := range [][2]string{{ScopeAccount, email}, {ScopeIP, ip}} {
+		scope, subject := key[0], key[1]
+		attempts, err := s.store.RecordLoginFailure(ctx, scope, subject, now, now.Add(-loginFailureWindow))
+		if err != nil {
+			return err
+		}
+
+		delay, lockout := loginPolicies[scope].delay(attempts.Failures)
+		if delay == 0 {
+			continue
+		}
+		if err := s.store.SetLoginLock(ctx, scope, subject, now.Add(delay)); err != nil {
+			return err
+		}
+		if !lockout {
+			continue
+		}
+
+		event := &Lockout{
+			Scope:       scope,
+			Subject:     subject,
+			Failures:    attempts.Failures,
+			CreatedAt:   now,
+			LockedUntil: now.Add(delay),
+		}
+		if scope == ScopeAccount && user != nil {
+			event.UserID = user.ID
+		}
+		if err := s.store.CreateLockout(ctx, event); err != nil {
+			return err
+		}
+		// The subject is an email or an IP; emails are masked in the log
+		key := "ip"
+		if scope == ScopeAccount {
+			key = "email"
+		}
+		slog.Warn("logins locked", "scope", scope, key, subject, "user_id", event.UserID,
+			"locked_until", event.LockedUntil, "failures", attempts.Failures)
+	}
+	return nil
+}
+
+// GET /lockouts lists the most recent lockouts, newest first.
+func (s *APIServer) handleGetLockouts(w http.ResponseWriter, r *http.Request) error {
+	if err := requirePermission(r, PermViewUsers); err != nil {
+		return err
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 1000 {
+			return validationError("invalid limit: %s", l)
+		}
+		limit = n
+	}
+
+	lockouts, err := s.store.GetLockouts(r.Context(), limit)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, lockouts)
+}
+
+// DELETE /lockouts/{id} lifts a lockout, account or IP, and forgets the
+// failures that led to it.
+func (s *APIServer) handleUnlockLockout(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
+		return err
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid lockout ID: %s", idStr)
+	}
+
+	lockout, err := s.store.GetLockout(ctx, id)
+	if err != nil {
+		return err
+	}
+	if lockout == nil {
+		return fmt.Errorf("%w with ID: %d", ErrLockoutNotFound, id)
+	}
+
+	if err := s.store.UnlockLogin(ctx, lockout.Scope, lockout.Subject, currentUser(r).ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DELETE /users/{id}/lockout lets a user log in again straight away.
+func (s *APIServer) handleUnlockUser(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
+		return err
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	user, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w with ID: %d", ErrUserNotFound, id)
+	}
+
+	if err := s.store.UnlockLogin(ctx, ScopeAccount, normalizeEmail(user.Email), currentUser(r).ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// recordLoginFailure is the shared SQL implementation of
+// Storage.RecordLoginFailure. It also drops counts that have run out.
+func recordLoginFailure(ctx context.Context, db *sql.DB, scope, subject string, at, since time.Time) (*LoginAttempts, error) {
+	_, err := db.ExecContext(ctx, `DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)`,
+		since, at)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := &LoginAttempts{Scope: scope, Subject: subject, LastFailureAt: at}
+	var lockedUntil sql.NullTime
+	err = db.QueryRowContext(ctx, `INSERT INTO login_attempts (scope, subject, failures, last_failure_at) VALUES ($1, $2, 1, $3)
+		ON CONFLICT (scope, subject) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $4 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = $3
+		RETURNING failures, locked_until`,
+		scope, subject, at, since).Scan(&attempts.Failures, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		attempts.LockedUntil = &lockedUntil.Time
+	}
+	return attempts, nil
+}
+
+func getLoginAttempts(ctx context.Context, db *sql.DB, scope, subject string) (*LoginAttempts, error) {
+	attempts := &LoginAttempts{Scope: scope, Subject: subject}
+	var lockedUntil sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE scope = $1 AND subject = $2`,
+		scope, subject).Scan(&attempts.Failures, &attempts.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		attempts.LockedUntil = &lockedUntil.Time
+	}
+	return attempts, nil
+}
+
+func setLoginLock(ctx context.Context, db *sql.DB, scope, subject string, until time.Time) error {
+	_, err := db.ExecContext(ctx, `UPDATE login_attempts SET locked_until = $1 WHERE scope = $2 AND subject = $3`,
+		until, scope, subject)
+	return err
+}
+
+func clearLoginFailures(ctx context.Context, db *sql.DB, scope, subject string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM login_attempts WHERE scope = $1 AND subject = $2`, scope, subject)
+	return err
+}
+
+func insertLockout(ctx context.Context, db *sql.DB, lockout *Lockout) error {
+	var userID sql.NullInt64
+	if lockout.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(lockout.UserID), Valid: true}
+	}
+	return db.QueryRowContext(ctx, `INSERT INTO login_lockouts (scope, subject, user_id, failures, created_at, locked_until)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		lockout.Scope, lockout.Subject, userID, lockout.Failures, lockout.CreatedAt, lockout.LockedUntil).Scan(&lockout.ID)
+}
+
+// lockoutColumns is the column list read by scanLockout.
+const lockoutColumns = `id, scope, subject, COALESCE(user_id, 0), failures, created_at, locked_until, unlocked_at, COALESCE(unlocked_by, 0)`
+
+func scanLockout(row interface{ Scan(...any) error }) (*Lockout, error) {
+	lockout := new(Lockout)
+	var unlockedAt sql.NullTime
+	err := row.Scan(&lockout.ID, &lockout.Scope, &lockout.Subject, &lockout.UserID, &lockout.Failures,
+		&lockout.CreatedAt, &lockout.LockedUntil, &unlockedAt, &lockout.UnlockedBy)
+	if err != nil {
+		return nil, err
+	}
+	if unlockedAt.Valid {
+		lockout.UnlockedAt = &unlockedAt.Time
+	}
+	return lockout, nil
+}
+
+func queryLockouts(ctx context.Context, db *sql.DB, limit int) ([]*Lockout, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+lockoutColumns+` FROM login_lockouts ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []*Lockout{}
+	for rows.Next() {
+		lockout, err := scanLockout(rows)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	return lockouts, rows.Err()
+}
+
+func getLockout(ctx context.Context, db *sql.DB, id int) (*Lockout, error) {
+	lockout, err := scanLockout(db.QueryRowContext(ctx, `SELECT `+lockoutColumns+` FROM login_lockouts WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return lockout, err
+}
+
+// unlockLogin is the shared SQL implementation of Storage.UnlockLogin.
+func unlockLogin(ctx context.Context, db *sql.DB, scope, subject string, unlockedBy int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE scope = $1 AND subject = $2`, scope, subject); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, `UPDATE login_lockouts SET unlocked_at = $1, unlocked_by = $2
+		WHERE scope = $3 AND subject = $4 AND unlocked_at IS NULL AND locked_until > $1`,
+		now, unlockedBy, scope, subject)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
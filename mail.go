@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// newMailer returns the Mailer selected by MAILER:
+//
+//	log   write messages to standard error (the default)
+//	file  write each message to a file in MAIL_DIR
+//	smtp  send through SMTP_HOST:SMTP_PORT, authenticating with
+//	      SMTP_USERNAME and SMTP_PASSWORD if set
+//
+// MAIL_FROM is the sender address.
+func newMailer(cfg *Config) (Mailer, error) {
+	switch cfg.Mailer {
+	case "log":
+		return LogMailer{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.MailDir, 0o700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: cfg.MailDir, From: cfg.MailFrom}, nil
+	case "smtp":
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", cfg.Mailer)
+	}
+}
+
+// formatMessage builds an RFC 5322 message. Line breaks are removed from
+// the headers so a crafted address can't inject more of them.
+func formatMessage(from, to, subject, body string) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(to))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// LogMailer writes messages to standard error instead of sending them. It is
+// meant for local development, so the links in the messages can be opened
+// directly. Messages are written in full, links included, and don't go
+// through the redacting logger: don't use it in production.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	_, err := fmt.Fprintf(os.Stderr, "Email to %s: %s\n%s\n", to, subject, body)
+	return err
+}
+
+// FileMailer writes each message to its own .eml file in Dir.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), sanitizeFileName(to))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, to, subject, body), 0o600)
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// SMTPMailer sends through an SMTP server. net/smtp upgrades to TLS when the
+// server offers STARTTLS, and refuses to send credentials without it.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{to}, formatMessage(m.From, to, subject, body))
+}
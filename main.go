@@ -1,94 +1,122 @@
 package main
 
 import (
-	"database/sql"
-	"log"
-
-	// "os"
-	"time"
-
-	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// Load the .env file
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	cfg, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("loading configuration failed", err)
 	}
 
-	store, err := newPostGresStore()
+	if err := setupLogger(os.Stderr, cfg); err != nil {
+		fatal("configuring logger failed", err)
+	}
+	slog.Info("effective configuration", "config", cfg)
+
+	store, err := newStore(cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal("opening storage failed", err)
 	}
 
-	// Drop existing tables
-	// if err := dropTables(store.db); err != nil {
-	// 	log.Fatal("Error dropping tables:", err)
-	// }
+	// "gobank migrate ..." applies or inspects schema migrations and exits
+	if len(args) > 0 && args[0] == "migrate" {
+		err := runMigrateCommand(store, args[1:])
+		closeStore(store)
+		if err != nil {
+			fatal("migrate failed", err)
+		}
+		return
+	}
 
-	if err := store.Init(); err != nil {
-		log.Fatal(err)
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		fatal("loading JWT keys failed", err)
 	}
 
-	monopolyPassword := "megapassword"
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(monopolyPassword), bcrypt.DefaultCost)
+	mailer, err := newMailer(cfg)
 	if err != nil {
-		log.Fatal("Error hashing Monopoly Bank password:", err)
+		fatal("configuring mailer failed", err)
 	}
-	// Create a user for the Monopoly Bank
-	monopolyUser := &User{
-		FirstName: "Monopoly",
-		LastName:  "Bank",
-		Email:     "admin@gmail.com",
-		Password:  string(hashedPassword),
-		CreatedAt: time.Now().UTC(),
-		Balance:   999999999, // Set initial balance
-		Number:    999999,    // Set account number
+
+	passwords, err := loadPasswordPolicy(cfg)
+	if err != nil {
+		fatal("loading password policy failed", err)
 	}
 
-	// Create the user in the database
-	if err := store.CreateUser(monopolyUser); err != nil {
-		log.Fatal("Error creating Monopoly Bank user:", err)
+	if s, ok := store.(interface{ Init() error }); ok {
+		if err := s.Init(); err != nil {
+			fatal("initializing storage failed", err)
+		}
 	}
 
-	server := NewAPIServer(":3000", store)
-	server.Run()
-}
+	// SIGINT or SIGTERM stops the server gracefully, or the bootstrap if the
+	// database hangs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-// Function to create the Monopoly Bank account
-func createMonopolyBankAccount(store Storage, userID int) error {
-	// Check if the Monopoly Bank account already exists
-	existingAccount, err := store.GetUserByID(1) // Change to the correct ID if needed
-	if err != nil {
-		return err
+	if err := bootstrapSystemAccounts(ctx, store, cfg, passwords); err != nil {
+		fatal("bootstrapping system accounts failed", err)
 	}
 
-	if existingAccount != nil {
-		log.Println("Monopoly Bank account already exists.")
-		return nil // Account already exists, no need to create
+	server := NewAPIServer(cfg.ListenAddr, store, keys)
+	server.totpTransferThreshold = cfg.TOTPTransferThreshold
+	server.mailer = mailer
+	server.passwords = passwords
+	server.appURL = cfg.AppURL
+	server.corsOrigins = cfg.CORSOrigins
+	server.registrationEnabled = cfg.RegistrationEnabled
+	server.requireVerifiedEmail = cfg.RequireVerifiedEmail
+	server.timeouts = cfg.Timeouts
+
+	err = server.Run(ctx)
+	closeStore(store)
+	if err != nil {
+		fatal("server failed", err)
 	}
+}
 
-	// Create a new Monopoly Bank account with the user ID
-	monopolyAccount := &User{
-		FirstName: "Monopoly",
-		LastName:  "Bank",
-		Email:     "monopolybank@example.com", // Assuming a default email for the Monopoly Bank
-		Password:  "monopolybankpassword",     // Assuming a default password for the Monopoly Bank
-		CreatedAt: time.Now().UTC(),
-		Balance:   999999999,
-		Number:    999999,
+// closeStore releases the store's database connections, if it has any.
+func closeStore(store Storage) {
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Error("closing storage failed", "err", err)
+		}
 	}
+}
 
-	return store.CreateUser(monopolyAccount)
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
-func dropTables(db *sql.DB) error {
-	// _, err := db.Exec(`DROP TABLE IF EXISTS account CASCADE;`)
-	// if err != nil {
-	// 	return err
-	// }
-	_, err := db.Exec(`DROP TABLE IF EXISTS users CASCADE;`)
-	_, err = db.Exec(`DROP TABLE IF EXISTS transactions CASCADE;`)
-	return err
+// newStore opens the Storage backend selected by STORAGE. Postgres is the
+// default and connects to DATABASE_URL; "sqlite" uses the file named by
+// SQLITE_PATH and "memory" keeps everything in process and needs no
+// database. The schema is not touched; call Init (or the migrate command)
+// afterwards.
+func newStore(cfg *Config) (Storage, error) {
+	switch cfg.Storage {
+	case "postgres":
+		return newPostGresStore(cfg.DatabaseURL)
+	case "sqlite":
+		return newSQLiteStore(cfg.SQLitePath)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Storage)
+	}
 }
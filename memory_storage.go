@@ -0,0 +1,916 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type idempotencyScope struct {
+	userID int
+	key    string
+}
+
+type loginAttemptKey struct {
+	scope   string
+	subject string
+}
+
+// MemoryStore is an in-memory implementation of Storage. It mirrors the
+// behavior of PostgresStore and is meant for tests, demos and local runs
+// that don't have a database available.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	users         map[int]*User
+	accounts      map[int]*Account
+	entries       []*JournalEntry
+	idempotency   map[idempotencyScope]*IdempotencyRecord
+	refreshTokens map[string]*RefreshToken
+	revokedTokens map[string]time.Time
+	totpSteps     map[int]int64
+	recoveryCodes map[int]map[string]bool
+	userTokens    map[string]*UserToken
+	loginAttempts map[loginAttemptKey]*LoginAttempts
+	lockouts      []*Lockout
+	passwords     map[int][]string
+	nextUserID    int
+	nextAccountID int
+	nextPostingID int
+}
+
+func newMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		users:         map[int]*User{},
+		accounts:      map[int]*Account{},
+		idempotency:   map[idempotencyScope]*IdempotencyRecord{},
+		refreshTokens: map[string]*RefreshToken{},
+		revokedTokens: map[string]time.Time{},
+		totpSteps:     map[int]int64{},
+		recoveryCodes: map[int]map[string]bool{},
+		userTokens:    map[string]*UserToken{},
+		loginAttempts: map[loginAttemptKey]*LoginAttempts{},
+		passwords:     map[int][]string{},
+		nextUserID:    1,
+		nextAccountID: 1,
+		nextPostingID: 1,
+	}
+
+	mint := &Account{
+		ID:        s.nextAccountID,
+		Type:      AccountSystem,
+		Status:    AccountOpen,
+		CreatedAt: time.Now().UTC(),
+		SystemKey: mintSystemKey,
+	}
+	s.accounts[mint.ID] = mint
+	s.nextAccountID++
+
+	return s
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.Email, user.Email) {
+			return ErrEmailTaken
+		}
+		if user.SystemKey != "" && u.SystemKey == user.SystemKey {
+			return fmt.Errorf("system user %q already exists", user.SystemKey)
+		}
+	}
+
+	user.ID = s.nextUserID
+	s.nextUserID++
+
+	stored := *user
+	s.users[user.ID] = &stored
+	return nil
+}
+
+// DeleteUser removes a user together with their accounts. Accounts that
+// already have transactions keep the user from being deleted.
+func (s *MemoryStore) DeleteUser(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
+	}
+
+	for _, entry := range s.entries {
+		for _, p := range entry.Postings {
+			if s.accounts[p.AccountID].UserID == id {
+				return fmt.Errorf("%w (user ID %d)", ErrUserHasTransactions, id)
+			}
+		}
+	}
+
+	for accountID, account := range s.accounts {
+		if account.UserID == id {
+			delete(s.accounts, accountID)
+		}
+	}
+	for hash, token := range s.refreshTokens {
+		if token.UserID == id {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for hash, token := range s.userTokens {
+		if token.UserID == id {
+			delete(s.userTokens, hash)
+		}
+	}
+	delete(s.passwords, id)
+	delete(s.totpSteps, id)
+	delete(s.recoveryCodes, id)
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[user.ID]
+	if !ok {
+		return nil
+	}
+	for _, u := range s.users {
+		if u.ID != user.ID && strings.EqualFold(u.Email, user.Email) {
+			return ErrEmailTaken
+		}
+	}
+
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.Email = user.Email
+	existing.Password = user.Password
+	existing.Role = user.Role
+	existing.TOTPSecret = user.TOTPSecret
+	existing.TOTPEnabled = user.TOTPEnabled
+	existing.EmailVerified = user.EmailVerified
+	existing.SystemKey = user.SystemKey
+	return nil
+}
+
+func (s *MemoryStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, nil // No user found
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context) ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		u := *user
+		users = append(users, &u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users, nil
+}
+
+func (s *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, strings.TrimSpace(email)) {
+			u := *user
+			return &u, nil
+		}
+	}
+	return nil, fmt.Errorf("%w with email %s", ErrUserNotFound, email)
+}
+
+// CreateAccount stores account, generating a unique account number unless
+// one is already set. A non-zero Balance is posted as an opening balance.
+func (s *MemoryStore) CreateAccount(ctx context.Context, account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[account.UserID]; !ok {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, account.UserID)
+	}
+
+	if account.Balance < 0 {
+		return validationError("opening balance cannot be negative")
+	}
+
+	if account.Number == 0 {
+		for {
+			number, err := newAccountNumber()
+			if err != nil {
+				return err
+			}
+			if s.accountByNumber(number) == nil {
+				account.Number = number
+				break
+			}
+		}
+	} else if s.accountByNumber(account.Number) != nil {
+		return fmt.Errorf("account number %d already exists", account.Number)
+	}
+
+	account.ID = s.nextAccountID
+	s.nextAccountID++
+
+	stored := *account
+	stored.Balance = 0
+	s.accounts[account.ID] = &stored
+
+	if account.Balance != 0 {
+		mint := s.accountBySystemKey(mintSystemKey)
+		s.postJournalEntry(EntryOpening, fmt.Sprintf("opening balance for account %d", account.ID), []Posting{
+			{AccountID: mint.ID, Amount: -account.Balance},
+			{AccountID: account.ID, Amount: account.Balance},
+		})
+	}
+	return nil
+}
+
+// accountBySystemKey finds a system account. The caller must hold s.mu.
+func (s *MemoryStore) accountBySystemKey(key string) *Account {
+	for _, account := range s.accounts {
+		if account.SystemKey == key {
+			return account
+		}
+	}
+	return nil
+}
+
+// CloseAccount marks an account as closed. Only accounts with a zero balance
+// can be closed.
+func (s *MemoryStore) CloseAccount(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return fmt.Errorf("%w with ID %d", ErrAccountNotFound, id)
+	}
+
+	if account.Status == AccountClosed {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, id)
+	}
+	if account.Balance != 0 {
+		return fmt.Errorf("%w of %d (account ID %d)", ErrAccountNotEmpty, account.Balance, id)
+	}
+
+	account.Status = AccountClosed
+	return nil
+}
+
+func (s *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, nil // No account found
+	}
+	a := *account
+	return &a, nil
+}
+
+func (s *MemoryStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account := s.accountByNumber(number)
+	if account == nil {
+		return nil, nil // No account found
+	}
+	a := *account
+	return &a, nil
+}
+
+// accountByNumber finds an account by number. The caller must hold s.mu.
+func (s *MemoryStore) accountByNumber(number int64) *Account {
+	for _, account := range s.accounts {
+		if account.Number == number {
+			return account
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetAccountsByUser(ctx context.Context, userID int) ([]*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := []*Account{}
+	for _, account := range s.accounts {
+		if account.UserID == userID {
+			a := *account
+			accounts = append(accounts, &a)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+
+	return accounts, nil
+}
+
+func (s *MemoryStore) TransferFunds(ctx context.Context, fromID, toID int64, amount int64) error {
+	if err := validateTransfer(fromID, toID, amount); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, ok := s.accounts[int(fromID)]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, fromID)
+	}
+	if from.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, fromID)
+	}
+
+	to, ok := s.accounts[int(toID)]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrUnknownRecipient, toID)
+	}
+	if to.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, toID)
+	}
+
+	if from.Balance < amount {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, fromID)
+	}
+
+	s.postJournalEntry(EntryTransfer, fmt.Sprintf("transfer from account %d to account %d", fromID, toID), []Posting{
+		{AccountID: from.ID, Amount: -amount},
+		{AccountID: to.ID, Amount: amount},
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) AdjustBalance(ctx context.Context, accountID int64, amount int64, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[int(accountID)]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, accountID)
+	}
+	if account.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, accountID)
+	}
+	if account.Balance+amount < 0 {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, accountID)
+	}
+
+	mint := s.accountBySystemKey(mintSystemKey)
+	s.postJournalEntry(EntryAdjustment, description, []Posting{
+		{AccountID: mint.ID, Amount: -amount},
+		{AccountID: account.ID, Amount: amount},
+	})
+	return nil
+}
+
+// postJournalEntry records an entry and applies its postings to the account
+// balances. The postings must sum to zero and the caller must hold s.mu.
+func (s *MemoryStore) postJournalEntry(kind, description string, postings []Posting) {
+	now := time.Now().UTC()
+	entry := &JournalEntry{
+		ID:          len(s.entries) + 1,
+		Kind:        kind,
+		Description: description,
+		CreatedAt:   now,
+	}
+
+	for _, p := range postings {
+		p.ID = s.nextPostingID
+		p.EntryID = entry.ID
+		p.CreatedAt = now
+		s.nextPostingID++
+
+		entry.Postings = append(entry.Postings, p)
+		s.accounts[p.AccountID].Balance += p.Amount
+	}
+
+	s.entries = append(s.entries, entry)
+}
+
+func (s *MemoryStore) GetBalance(ctx context.Context, accountID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return 0, fmt.Errorf("%w with ID %d", ErrAccountNotFound, accountID)
+	}
+	return account.Balance, nil
+}
+
+func (s *MemoryStore) GetTransactions(ctx context.Context, accountID int) ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var transactions []Transaction
+	for _, entry := range s.entries {
+		for _, p := range entry.Postings {
+			if p.AccountID == accountID {
+				transactions = append(transactions, Transaction{
+					ID:        p.ID,
+					AccountID: p.AccountID,
+					EntryID:   p.EntryID,
+					Amount:    p.Amount,
+					Type:      transactionType(entry.Kind, p.Amount),
+					CreatedAt: p.CreatedAt,
+				})
+			}
+		}
+	}
+	return transactions, nil
+}
+
+func (s *MemoryStore) GetJournalEntries(ctx context.Context, afterID, limit int) ([]*JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []*JournalEntry{}
+	for _, entry := range s.entries {
+		if entry.ID <= afterID {
+			continue
+		}
+		if len(entries) == limit {
+			break
+		}
+		e := *entry
+		e.Postings = append([]Posting{}, entry.Postings...)
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) ReconcileLedger(ctx context.Context) (*LedgerReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := &LedgerReport{
+		UnbalancedEntries: []int{},
+		Discrepancies:     []AccountReconciliation{},
+	}
+
+	ledgerBalances := map[int]int64{}
+	for _, entry := range s.entries {
+		var total int64
+		for _, p := range entry.Postings {
+			total += p.Amount
+			ledgerBalances[p.AccountID] += p.Amount
+		}
+		if total != 0 {
+			report.UnbalancedEntries = append(report.UnbalancedEntries, entry.ID)
+		}
+		report.PostingsTotal += total
+	}
+
+	for _, account := range s.accounts {
+		if account.Balance != ledgerBalances[account.ID] {
+			report.Discrepancies = append(report.Discrepancies, AccountReconciliation{
+				AccountID:     account.ID,
+				Balance:       account.Balance,
+				LedgerBalance: ledgerBalances[account.ID],
+			})
+		}
+	}
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		return report.Discrepancies[i].AccountID < report.Discrepancies[j].AccountID
+	})
+
+	report.check()
+	return report, nil
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := idempotencyScope{record.UserID, record.Key}
+	if existing, ok := s.idempotency[scope]; ok && existing.CreatedAt.After(record.CreatedAt.Add(-idempotencyKeyTTL)) {
+		r := *existing
+		return &r, nil
+	}
+
+	stored := *record
+	stored.StatusCode = 0
+	stored.Body = nil
+	s.idempotency[scope] = &stored
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[idempotencyScope{record.UserID, record.Key}]
+	if !ok {
+		return nil
+	}
+	stored.StatusCode = record.StatusCode
+	stored.Body = append([]byte(nil), record.Body...)
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, idempotencyScope{userID, key})
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, stored := range s.refreshTokens {
+		if stored.ExpiresAt.Before(token.CreatedAt) {
+			delete(s.refreshTokens, hash)
+		}
+	}
+
+	stored := *token
+	s.refreshTokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) ConsumeRefreshToken(ctx context.Context, hash string) (*RefreshToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refreshTokens[hash]
+	if !ok {
+		return nil, false, nil
+	}
+
+	reused := stored.RevokedAt != nil
+	if !reused {
+		now := time.Now().UTC()
+		stored.RevokedAt = &now
+	}
+
+	token := *stored
+	return &token, reused, nil
+}
+
+func (s *MemoryStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeRefreshTokens(func(token *RefreshToken) bool { return token.FamilyID == familyID })
+	return nil
+}
+
+func (s *MemoryStore) RevokeUserTokens(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeRefreshTokens(func(token *RefreshToken) bool { return token.UserID == userID })
+	return nil
+}
+
+// revokeRefreshTokens revokes the matching refresh tokens and the access
+// tokens issued with them. The caller must hold s.mu.
+func (s *MemoryStore) revokeRefreshTokens(match func(*RefreshToken) bool) {
+	now := time.Now().UTC()
+	for _, token := range s.refreshTokens {
+		if !match(token) {
+			continue
+		}
+		if token.AccessExpiresAt.After(now) {
+			s.revokedTokens[token.AccessJTI] = token.AccessExpiresAt
+		}
+		if token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+}
+
+func (s *MemoryStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for revoked, revokedExpiresAt := range s.revokedTokens {
+		if revokedExpiresAt.Before(now) {
+			delete(s.revokedTokens, revoked)
+		}
+	}
+
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revokedTokens[jti]
+	return ok, nil
+}
+
+func (s *MemoryStore) UpdateUserProfile(ctx context.Context, id int, update *ProfileUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
+	}
+
+	if update.Email != nil {
+		for _, u := range s.users {
+			if u.ID != id && strings.EqualFold(u.Email, *update.Email) {
+				return ErrEmailTaken
+			}
+		}
+		existing.Email = *update.Email
+		existing.EmailVerified = false
+	}
+	if update.FirstName != nil {
+		existing.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		existing.LastName = *update.LastName
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetPassword(ctx context.Context, id int, hash string) error {
+	return s.updateUser(id, func(u *User) { u.Password = hash })
+}
+
+func (s *MemoryStore) SetTOTP(ctx context.Context, id int, secret string, enabled bool) error {
+	return s.updateUser(id, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = enabled
+	})
+}
+
+func (s *MemoryStore) SetEmailVerified(ctx context.Context, id int, verified bool) error {
+	return s.updateUser(id, func(u *User) { u.EmailVerified = verified })
+}
+
+func (s *MemoryStore) SetRole(ctx context.Context, id int, role Role) error {
+	return s.updateUser(id, func(u *User) { u.Role = role })
+}
+
+// updateUser applies change to the stored user with the given ID.
+func (s *MemoryStore) updateUser(id int, change func(*User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
+	}
+	change(user)
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if step <= s.totpSteps[userID] {
+		return false, nil
+	}
+	s.totpSteps[userID] = step
+	return true, nil
+}
+
+// ReplaceRecoveryCodes stores the hashes as unused codes. The value of each
+// is whether the code has been used.
+func (s *MemoryStore) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codes := map[string]bool{}
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	s.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recoveryCodes[userID][hash] = true
+	return true, nil
+}
+
+func (s *MemoryStore) CreateUserToken(ctx context.Context, token *UserToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, existing := range s.userTokens {
+		if (existing.UserID == token.UserID && existing.Purpose == token.Purpose) || existing.ExpiresAt.Before(token.CreatedAt) {
+			delete(s.userTokens, hash)
+		}
+	}
+	stored := *token
+	s.userTokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) ConsumeUserToken(ctx context.Context, hash, purpose string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.userTokens[hash]
+	if !ok || token.Purpose != purpose || !token.ExpiresAt.After(time.Now()) {
+		return 0, nil
+	}
+	delete(s.userTokens, hash)
+	return token.UserID, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, scope, subject string, at, since time.Time) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := loginAttemptKey{scope, subject}
+	attempts, ok := s.loginAttempts[key]
+	if !ok {
+		attempts = &LoginAttempts{Scope: scope, Subject: subject}
+		s.loginAttempts[key] = attempts
+	}
+	if attempts.LastFailureAt.Before(since) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = at
+
+	copied := *attempts
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetLoginAttempts(ctx context.Context, scope, subject string) (*LoginAttempts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	attempts, ok := s.loginAttempts[loginAttemptKey{scope, subject}]
+	if !ok {
+		return nil, nil
+	}
+	copied := *attempts
+	return &copied, nil
+}
+
+func (s *MemoryStore) SetLoginLock(ctx context.Context, scope, subject string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempts, ok := s.loginAttempts[loginAttemptKey{scope, subject}]; ok {
+		attempts.LockedUntil = &until
+	}
+	return nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(ctx context.Context, scope, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginAttempts, loginAttemptKey{scope, subject})
+	return nil
+}
+
+func (s *MemoryStore) CreateLockout(ctx context.Context, lockout *Lockout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lockout.ID = len(s.lockouts) + 1
+	stored := *lockout
+	s.lockouts = append(s.lockouts, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetLockouts(ctx context.Context, limit int) ([]*Lockout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lockouts := []*Lockout{}
+	for i := len(s.lockouts) - 1; i >= 0 && len(lockouts) < limit; i-- {
+		copied := *s.lockouts[i]
+		lockouts = append(lockouts, &copied)
+	}
+	return lockouts, nil
+}
+
+func (s *MemoryStore) GetLockout(ctx context.Context, id int) (*Lockout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > len(s.lockouts) {
+		return nil, nil
+	}
+	copied := *s.lockouts[id-1]
+	return &copied, nil
+}
+
+func (s *MemoryStore) UnlockLogin(ctx context.Context, scope, subject string, unlockedBy int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginAttempts, loginAttemptKey{scope, subject})
+
+	now := time.Now().UTC()
+	for _, lockout := range s.lockouts {
+		if lockout.Scope == scope && lockout.Subject == subject && lockout.UnlockedAt == nil && lockout.LockedUntil.After(now) {
+			lockout.UnlockedAt = &now
+			lockout.UnlockedBy = unlockedBy
+		}
+	}
+	return nil
+}
+
+// AddPasswordHistory keeps the hashes oldest first.
+func (s *MemoryStore) AddPasswordHistory(ctx context.Context, userID int, hash string, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := append(s.passwords[userID], hash)
+	if len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	s.passwords[userID] = history
+	return nil
+}
+
+func (s *MemoryStore) GetPasswordHistory(ctx context.Context, userID, limit int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := s.passwords[userID]
+	hashes := []string{}
+	for i := len(history) - 1; i >= 0 && len(hashes) < limit; i-- {
+		hashes = append(hashes, history[i])
+	}
+	return hashes, nil
+}
+
+func (s *MemoryStore) GetUserBySystemKey(ctx context.Context, key string) (*User, error) {
+	// Ordinary users have no key; the SQL stores keep it NULL for them
+	if key == "" {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.SystemKey == key {
+			u := *user
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) EnsureSystemAccount(ctx context.Context, key string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account := s.accountBySystemKey(key)
+	if account == nil {
+		account = &Account{
+			ID:        s.nextAccountID,
+			Type:      AccountSystem,
+			Status:    AccountOpen,
+			CreatedAt: time.Now().UTC(),
+			SystemKey: key,
+		}
+		s.accounts[account.ID] = account
+		s.nextAccountID++
+	}
+	account.Type = AccountSystem
+	account.Status = AccountOpen
+	account.UserID = 0
+
+	a := *account
+	return &a, nil
+}
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Migration is a single versioned schema change. Up applies it and Down
+// reverts it; both may contain several statements. UpFunc, if set, runs
+// after Up in the same transaction for data changes that are easier to
+// express in Go.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	UpFunc  func(*sql.Tx) error
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator applies an ordered list of migrations and records the schema
+// version in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func newMigrator(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+func (m *Migrator) createVersionTable() error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`
+	_, err := m.db.Exec(query)
+	return err
+}
+
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	if err := m.createVersionTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Version returns the highest applied migration version, or 0 for an empty
+// database.
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Up applies every pending migration in version order.
+func (m *Migrator) Up() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := m.apply(migration); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// Down reverts the most recently applied migrations, newest first.
+func (m *Migrator) Down(steps int) error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := m.revert(migration); err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// Status lists every known migration and when it was applied.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) apply(migration Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if migration.Up != "" {
+		if _, err := tx.Exec(migration.Up); err != nil {
+			return err
+		}
+	}
+
+	if migration.UpFunc != nil {
+		if err := migration.UpFunc(tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+		migration.Version, migration.Name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) revert(migration Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if migration.Down != "" {
+		if _, err := tx.Exec(migration.Down); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migratable is implemented by the SQL-backed stores.
+type migratable interface {
+	migrator() *Migrator
+}
+
+// runMigrateCommand implements "gobank migrate <up|down [n]|status|version>".
+func runMigrateCommand(store Storage, args []string) error {
+	ms, ok := store.(migratable)
+	if !ok {
+		return fmt.Errorf("storage backend %T has no schema to migrate", store)
+	}
+	m := ms.migrator()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if err := m.Up(); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		if err := m.Down(steps); err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	case "version":
+	default:
+		return fmt.Errorf("unknown migrate command: %s (want up, down, status or version)", command)
+	}
+
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version: %d\n", version)
+	return nil
+}
+
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users_and_transactions",
+		Up: `CREATE TABLE IF NOT EXISTS users (
+			id SERIAL PRIMARY KEY,
+			first_name VARCHAR(50),
+			last_name VARCHAR(50),
+			email VARCHAR(100) UNIQUE NOT NULL,
+			password VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP,
+			balance BIGINT DEFAULT 100
+		);
+		CREATE TABLE IF NOT EXISTS transactions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`,
+		Down: `DROP TABLE IF EXISTS transactions;
+		DROP TABLE IF EXISTS users;`,
+	},
+	{
+		Version: 2,
+		Name:    "add_users_number",
+		Up:      `ALTER TABLE users ADD COLUMN IF NOT EXISTS number BIGINT;`,
+		Down:    `ALTER TABLE users DROP COLUMN IF EXISTS number;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_accounts",
+		Up: `CREATE TABLE accounts (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			type VARCHAR(20) NOT NULL DEFAULT 'checking',
+			number BIGINT,
+			balance BIGINT NOT NULL DEFAULT 0,
+			status VARCHAR(20) NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX accounts_user_id_idx ON accounts (user_id);
+		INSERT INTO accounts (user_id, type, number, balance, created_at)
+			SELECT id, 'checking', number, COALESCE(balance, 0), COALESCE(created_at, CURRENT_TIMESTAMP) FROM users ORDER BY id;
+		ALTER TABLE transactions ADD COLUMN account_id INTEGER REFERENCES accounts(id);
+		UPDATE transactions SET account_id = (SELECT a.id FROM accounts a WHERE a.user_id = transactions.user_id);
+		ALTER TABLE transactions ALTER COLUMN account_id SET NOT NULL;
+		ALTER TABLE transactions DROP COLUMN user_id;
+		ALTER TABLE users DROP COLUMN balance;
+		ALTER TABLE users DROP COLUMN number;`,
+		Down: `ALTER TABLE users ADD COLUMN balance BIGINT DEFAULT 100;
+		ALTER TABLE users ADD COLUMN number BIGINT;
+		UPDATE users SET balance = a.balance, number = a.number FROM accounts a
+			WHERE a.id = (SELECT MIN(id) FROM accounts WHERE user_id = users.id);
+		ALTER TABLE transactions ADD COLUMN user_id INTEGER REFERENCES users(id);
+		UPDATE transactions SET user_id = (SELECT a.user_id FROM accounts a WHERE a.id = transactions.account_id);
+		ALTER TABLE transactions ALTER COLUMN user_id SET NOT NULL;
+		ALTER TABLE transactions DROP COLUMN account_id;
+		DROP TABLE accounts;`,
+	},
+	{
+		Version: 4,
+		Name:    "assign_account_numbers",
+		UpFunc:  assignAccountNumbers,
+	},
+	{
+		Version: 5,
+		Name:    "unique_account_numbers",
+		Up:      `CREATE UNIQUE INDEX accounts_number_key ON accounts (number);`,
+		Down:    `DROP INDEX accounts_number_key;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_ledger",
+		Up: `ALTER TABLE accounts ALTER COLUMN user_id DROP NOT NULL;
+		ALTER TABLE accounts ADD COLUMN system_key VARCHAR(50);
+		CREATE UNIQUE INDEX accounts_system_key_key ON accounts (system_key);
+		INSERT INTO accounts (user_id, type, balance, status, system_key) VALUES (NULL, 'system', 0, 'open', 'mint');
+		CREATE TABLE journal_entries (
+			id SERIAL PRIMARY KEY,
+			kind VARCHAR(30) NOT NULL,
+			description VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE postings (
+			id SERIAL PRIMARY KEY,
+			entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount BIGINT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX postings_entry_id_idx ON postings (entry_id);
+		CREATE INDEX postings_account_id_idx ON postings (account_id);`,
+		UpFunc: migrateTransactionsToLedger,
+		Down: `DROP TABLE postings;
+		DROP TABLE journal_entries;
+		DELETE FROM accounts WHERE system_key IS NOT NULL;
+		DROP INDEX accounts_system_key_key;
+		ALTER TABLE accounts DROP COLUMN system_key;
+		ALTER TABLE accounts ALTER COLUMN user_id SET NOT NULL;`,
+	},
+	{
+		Version: 7,
+		Name:    "drop_transactions",
+		Up:      `DROP TABLE transactions;`,
+		Down: `CREATE TABLE transactions (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO transactions (account_id, amount, type, created_at)
+			SELECT p.account_id, p.amount, CASE WHEN p.amount < 0 THEN 'Sent' ELSE 'Received' END, p.created_at
+			FROM postings p
+			JOIN journal_entries j ON j.id = p.entry_id
+			JOIN accounts a ON a.id = p.account_id
+			WHERE j.kind = 'transfer' AND a.system_key IS NULL
+			ORDER BY p.id;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_idempotency_keys",
+		Up: `CREATE TABLE idempotency_keys (
+			user_id INTEGER NOT NULL DEFAULT 0,
+			idempotency_key VARCHAR(255) NOT NULL,
+			fingerprint VARCHAR(64) NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response_body TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, idempotency_key)
+		);
+		CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);`,
+		Down: `DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version: 9,
+		Name:    "non_negative_balances",
+		Up:      `ALTER TABLE accounts ADD CONSTRAINT accounts_balance_non_negative CHECK (balance >= 0 OR type = 'system');`,
+		Down:    `ALTER TABLE accounts DROP CONSTRAINT accounts_balance_non_negative;`,
+	},
+	{
+		Version: 10,
+		Name:    "add_users_role",
+		Up:      `ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'customer';`,
+		Down:    `ALTER TABLE users DROP COLUMN role;`,
+	},
+	{
+		Version: 11,
+		Name:    "create_refresh_tokens",
+		Up: `CREATE TABLE refresh_tokens (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			family_id VARCHAR(64) NOT NULL,
+			access_jti VARCHAR(64) NOT NULL,
+			access_expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		);
+		CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+		CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+		CREATE TABLE revoked_tokens (
+			jti VARCHAR(64) PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL
+		);`,
+		Down: `DROP TABLE revoked_tokens;
+		DROP TABLE refresh_tokens;`,
+	},
+	{
+		Version: 12,
+		Name:    "add_totp",
+		Up: `ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE recovery_codes (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP,
+			PRIMARY KEY (user_id, code_hash)
+		);`,
+		Down: `DROP TABLE recovery_codes;
+		ALTER TABLE users DROP COLUMN totp_last_step;
+		ALTER TABLE users DROP COLUMN totp_enabled;
+		ALTER TABLE users DROP COLUMN totp_secret;`,
+	},
+	{
+		// Users who signed up before verification existed are treated as
+		// verified, so they can keep sending transfers.
+		Version: 13,
+		Name:    "add_email_verification",
+		Up: `ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+		UPDATE users SET email_verified = TRUE;
+		CREATE TABLE user_tokens (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			purpose VARCHAR(20) NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX user_tokens_user_id_idx ON user_tokens (user_id);`,
+		Down: `DROP TABLE user_tokens;
+		ALTER TABLE users DROP COLUMN email_verified;`,
+	},
+	{
+		Version: 14,
+		Name:    "create_login_attempts",
+		Up: `CREATE TABLE login_attempts (
+			scope VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			failures INTEGER NOT NULL,
+			last_failure_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP,
+			PRIMARY KEY (scope, subject)
+		);
+		CREATE TABLE login_lockouts (
+			id SERIAL PRIMARY KEY,
+			scope VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			failures INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP NOT NULL,
+			unlocked_at TIMESTAMP,
+			unlocked_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+		);`,
+		Down: `DROP TABLE login_lockouts;
+		DROP TABLE login_attempts;`,
+	},
+	{
+		Version: 15,
+		Name:    "create_password_history",
+		Up: `CREATE TABLE password_history (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			password_hash VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX password_history_user_id_idx ON password_history (user_id);`,
+		Down: `DROP TABLE password_history;`,
+	},
+	{
+		// Emails are stored in lower case from now on. Existing emails are
+		// lowered unless that would clash with another user's; migration 18
+		// refuses to run until those clashes are resolved.
+		Version: 16,
+		Name:    "lowercase_emails",
+		Up: `UPDATE users SET email = LOWER(email) WHERE email <> LOWER(email)
+			AND NOT EXISTS (SELECT 1 FROM users other WHERE other.id <> users.id AND LOWER(other.email) = LOWER(users.email));
+		CREATE INDEX users_lower_email_idx ON users (LOWER(email));`,
+		Down: `DROP INDEX users_lower_email_idx;`,
+	},
+	{
+		// System users, such as the Monopoly Bank, are found by a stable
+		// key rather than by their email, which comes from the config.
+		Version: 17,
+		Name:    "add_system_users",
+		Up: `ALTER TABLE users ADD COLUMN system_key VARCHAR(50);
+		CREATE UNIQUE INDEX users_system_key_key ON users (system_key);`,
+		Down: `DROP INDEX users_system_key_key;
+		ALTER TABLE users DROP COLUMN system_key;`,
+	},
+	{
+		Version: 18,
+		Name:    "lowercase_remaining_emails",
+		UpFunc:  lowercaseEmails,
+	},
+	{
+		// A lookup by email finds at most one user.
+		Version: 19,
+		Name:    "unique_lower_emails",
+		Up: `DROP INDEX users_lower_email_idx;
+		CREATE UNIQUE INDEX users_lower_email_key ON users (LOWER(email));`,
+		Down: `DROP INDEX users_lower_email_key;
+		CREATE INDEX users_lower_email_idx ON users (LOWER(email));`,
+	},
+}
+
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users_and_transactions",
+		Up: `CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			first_name VARCHAR(50),
+			last_name VARCHAR(50),
+			email VARCHAR(100) UNIQUE NOT NULL,
+			password VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP,
+			balance BIGINT DEFAULT 100
+		);
+		CREATE TABLE IF NOT EXISTS transactions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);`,
+		Down: `DROP TABLE IF EXISTS transactions;
+		DROP TABLE IF EXISTS users;`,
+	},
+	{
+		Version: 2,
+		Name:    "add_users_number",
+		Up:      `ALTER TABLE users ADD COLUMN number BIGINT;`,
+		Down:    `ALTER TABLE users DROP COLUMN number;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_accounts",
+		Up: `CREATE TABLE accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			type VARCHAR(20) NOT NULL DEFAULT 'checking',
+			number BIGINT,
+			balance BIGINT NOT NULL DEFAULT 0,
+			status VARCHAR(20) NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX accounts_user_id_idx ON accounts (user_id);
+		INSERT INTO accounts (user_id, type, number, balance, created_at)
+			SELECT id, 'checking', number, COALESCE(balance, 0), COALESCE(created_at, CURRENT_TIMESTAMP) FROM users ORDER BY id;
+		CREATE TABLE transactions_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO transactions_new (id, account_id, amount, type, created_at)
+			SELECT t.id, a.id, t.amount, t.type, t.created_at FROM transactions t JOIN accounts a ON a.user_id = t.user_id;
+		DROP TABLE transactions;
+		ALTER TABLE transactions_new RENAME TO transactions;
+		ALTER TABLE users DROP COLUMN balance;
+		ALTER TABLE users DROP COLUMN number;`,
+		Down: `ALTER TABLE users ADD COLUMN balance BIGINT DEFAULT 100;
+		ALTER TABLE users ADD COLUMN number BIGINT;
+		UPDATE users SET
+			balance = (SELECT a.balance FROM accounts a WHERE a.user_id = users.id ORDER BY a.id LIMIT 1),
+			number = (SELECT a.number FROM accounts a WHERE a.user_id = users.id ORDER BY a.id LIMIT 1);
+		CREATE TABLE transactions_old (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+		INSERT INTO transactions_old (id, user_id, amount, type, created_at)
+			SELECT t.id, a.user_id, t.amount, t.type, t.created_at FROM transactions t JOIN accounts a ON a.id = t.account_id;
+		DROP TABLE transactions;
+		ALTER TABLE transactions_old RENAME TO transactions;
+		DROP TABLE accounts;`,
+	},
+	{
+		Version: 4,
+		Name:    "assign_account_numbers",
+		UpFunc:  assignAccountNumbers,
+	},
+	{
+		Version: 5,
+		Name:    "unique_account_numbers",
+		Up:      `CREATE UNIQUE INDEX accounts_number_key ON accounts (number);`,
+		Down:    `DROP INDEX accounts_number_key;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_ledger",
+		// SQLite can't drop NOT NULL in place, so accounts is rebuilt. The
+		// foreign key checks are deferred until commit so rows referencing
+		// accounts survive the drop.
+		Up: `PRAGMA defer_foreign_keys = ON;
+		CREATE TABLE accounts_copy AS SELECT * FROM accounts;
+		DROP TABLE accounts;
+		CREATE TABLE accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER REFERENCES users(id),
+			type VARCHAR(20) NOT NULL DEFAULT 'checking',
+			number BIGINT,
+			balance BIGINT NOT NULL DEFAULT 0,
+			status VARCHAR(20) NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			system_key VARCHAR(50)
+		);
+		INSERT INTO accounts (id, user_id, type, number, balance, status, created_at)
+			SELECT id, user_id, type, number, balance, status, created_at FROM accounts_copy;
+		DROP TABLE accounts_copy;
+		CREATE INDEX accounts_user_id_idx ON accounts (user_id);
+		CREATE UNIQUE INDEX accounts_number_key ON accounts (number);
+		CREATE UNIQUE INDEX accounts_system_key_key ON accounts (system_key);
+		INSERT INTO accounts (user_id, type, balance, status, system_key) VALUES (NULL, 'system', 0, 'open', 'mint');
+		CREATE TABLE journal_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind VARCHAR(30) NOT NULL,
+			description VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE postings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount BIGINT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX postings_entry_id_idx ON postings (entry_id);
+		CREATE INDEX postings_account_id_idx ON postings (account_id);`,
+		UpFunc: migrateTransactionsToLedger,
+		Down: `PRAGMA defer_foreign_keys = ON;
+		DROP TABLE postings;
+		DROP TABLE journal_entries;
+		DELETE FROM accounts WHERE system_key IS NOT NULL;
+		CREATE TABLE accounts_copy AS SELECT * FROM accounts;
+		DROP TABLE accounts;
+		CREATE TABLE accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			type VARCHAR(20) NOT NULL DEFAULT 'checking',
+			number BIGINT,
+			balance BIGINT NOT NULL DEFAULT 0,
+			status VARCHAR(20) NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO accounts (id, user_id, type, number, balance, status, created_at)
+			SELECT id, user_id, type, number, balance, status, created_at FROM accounts_copy;
+		DROP TABLE accounts_copy;
+		CREATE INDEX accounts_user_id_idx ON accounts (user_id);
+		CREATE UNIQUE INDEX accounts_number_key ON accounts (number);`,
+	},
+	{
+		Version: 7,
+		Name:    "drop_transactions",
+		Up:      `DROP TABLE transactions;`,
+		Down: `CREATE TABLE transactions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount INTEGER NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO transactions (account_id, amount, type, created_at)
+			SELECT p.account_id, p.amount, CASE WHEN p.amount < 0 THEN 'Sent' ELSE 'Received' END, p.created_at
+			FROM postings p
+			JOIN journal_entries j ON j.id = p.entry_id
+			JOIN accounts a ON a.id = p.account_id
+			WHERE j.kind = 'transfer' AND a.system_key IS NULL
+			ORDER BY p.id;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_idempotency_keys",
+		Up: `CREATE TABLE idempotency_keys (
+			user_id INTEGER NOT NULL DEFAULT 0,
+			idempotency_key VARCHAR(255) NOT NULL,
+			fingerprint VARCHAR(64) NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response_body TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, idempotency_key)
+		);
+		CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);`,
+		Down: `DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version: 9,
+		Name:    "non_negative_balances",
+		// SQLite can't add a CHECK constraint to an existing table, so the
+		// same rule is enforced with triggers.
+		Up: `CREATE TRIGGER accounts_balance_non_negative_insert
+			BEFORE INSERT ON accounts
+			WHEN NEW.balance < 0 AND NEW.type <> 'system'
+		BEGIN
+			SELECT RAISE(ABORT, 'CHECK constraint failed: accounts_balance_non_negative');
+		END;
+		CREATE TRIGGER accounts_balance_non_negative_update
+			BEFORE UPDATE OF balance, type ON accounts
+			WHEN NEW.balance < 0 AND NEW.type <> 'system'
+		BEGIN
+			SELECT RAISE(ABORT, 'CHECK constraint failed: accounts_balance_non_negative');
+		END;`,
+		Down: `DROP TRIGGER accounts_balance_non_negative_insert;
+		DROP TRIGGER accounts_balance_non_negative_update;`,
+	},
+	{
+		Version: 10,
+		Name:    "add_users_role",
+		Up:      `ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'customer';`,
+		Down:    `ALTER TABLE users DROP COLUMN role;`,
+	},
+	{
+		Version: 11,
+		Name:    "create_refresh_tokens",
+		Up: `CREATE TABLE refresh_tokens (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			family_id VARCHAR(64) NOT NULL,
+			access_jti VARCHAR(64) NOT NULL,
+			access_expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		);
+		CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+		CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+		CREATE TABLE revoked_tokens (
+			jti VARCHAR(64) PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL
+		);`,
+		Down: `DROP TABLE revoked_tokens;
+		DROP TABLE refresh_tokens;`,
+	},
+	{
+		Version: 12,
+		Name:    "add_totp",
+		Up: `ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE recovery_codes (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP,
+			PRIMARY KEY (user_id, code_hash)
+		);`,
+		Down: `DROP TABLE recovery_codes;
+		ALTER TABLE users DROP COLUMN totp_last_step;
+		ALTER TABLE users DROP COLUMN totp_enabled;
+		ALTER TABLE users DROP COLUMN totp_secret;`,
+	},
+	{
+		// Users who signed up before verification existed are treated as
+		// verified, so they can keep sending transfers.
+		Version: 13,
+		Name:    "add_email_verification",
+		Up: `ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+		UPDATE users SET email_verified = TRUE;
+		CREATE TABLE user_tokens (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			purpose VARCHAR(20) NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX user_tokens_user_id_idx ON user_tokens (user_id);`,
+		Down: `DROP TABLE user_tokens;
+		ALTER TABLE users DROP COLUMN email_verified;`,
+	},
+	{
+		Version: 14,
+		Name:    "create_login_attempts",
+		Up: `CREATE TABLE login_attempts (
+			scope VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			failures INTEGER NOT NULL,
+			last_failure_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP,
+			PRIMARY KEY (scope, subject)
+		);
+		CREATE TABLE login_lockouts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			scope VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			failures INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP NOT NULL,
+			unlocked_at TIMESTAMP,
+			unlocked_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+		);`,
+		Down: `DROP TABLE login_lockouts;
+		DROP TABLE login_attempts;`,
+	},
+	{
+		Version: 15,
+		Name:    "create_password_history",
+		Up: `CREATE TABLE password_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			password_hash VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX password_history_user_id_idx ON password_history (user_id);`,
+		Down: `DROP TABLE password_history;`,
+	},
+	{
+		// Emails are stored in lower case from now on. Existing emails are
+		// lowered unless that would clash with another user's; migration 18
+		// refuses to run until those clashes are resolved.
+		Version: 16,
+		Name:    "lowercase_emails",
+		Up: `UPDATE users SET email = LOWER(email) WHERE email <> LOWER(email)
+			AND NOT EXISTS (SELECT 1 FROM users other WHERE other.id <> users.id AND LOWER(other.email) = LOWER(users.email));
+		CREATE INDEX users_lower_email_idx ON users (LOWER(email));`,
+		Down: `DROP INDEX users_lower_email_idx;`,
+	},
+	{
+		// System users, such as the Monopoly Bank, are found by a stable
+		// key rather than by their email, which comes from the config.
+		Version: 17,
+		Name:    "add_system_users",
+		Up: `ALTER TABLE users ADD COLUMN system_key VARCHAR(50);
+		CREATE UNIQUE INDEX users_system_key_key ON users (system_key);`,
+		Down: `DROP INDEX users_system_key_key;
+		ALTER TABLE users DROP COLUMN system_key;`,
+	},
+	{
+		Version: 18,
+		Name:    "lowercase_remaining_emails",
+		UpFunc:  lowercaseEmails,
+	},
+	{
+		// A lookup by email finds at most one user.
+		Version: 19,
+		Name:    "unique_lower_emails",
+		Up: `DROP INDEX users_lower_email_idx;
+		CREATE UNIQUE INDEX users_lower_email_key ON users (LOWER(email));`,
+		Down: `DROP INDEX users_lower_email_key;
+		CREATE INDEX users_lower_email_idx ON users (LOWER(email));`,
+	},
+}
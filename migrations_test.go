@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLowercaseEmailsRejectsCaseClashes migrates a database that has two
+// users whose emails differ only in case. The migration must stop and name
+// them, and once they are resolved, no new case variant can be stored.
+func TestLowercaseEmailsRejectsCaseClashes(t *testing.T) {
+	ctx := context.Background()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "gobank.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeStore(store) })
+
+	// Go back to before the emails were made unique
+	m := store.migrator()
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+
+	jane := NewUser("Jane", "Doe", "jane@example.com", "")
+	janeAgain := NewUser("Jane", "Doe", "Jane@Example.com", "")
+	bob := NewUser("Bob", "Roe", "Bob@Example.com", "")
+	for _, user := range []*User{jane, janeAgain, bob} {
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = m.Up()
+	if err == nil {
+		t.Fatal("migration succeeded with clashing emails")
+	}
+	if want := fmt.Sprintf("user IDs: %d, %d", jane.ID, janeAgain.ID); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "example.com") {
+		t.Errorf("error %q contains an email", err)
+	}
+
+	if err := store.DeleteUser(ctx, janeAgain.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.GetUserByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.ID != bob.ID || found.Email != "bob@example.com" {
+		t.Errorf("got %+v, want user %d with the email lowered", found, bob.ID)
+	}
+
+	err = store.CreateUser(ctx, NewUser("Jane", "Doe", "JANE@example.com", ""))
+	if !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("creating a case variant: got %v, want %v", err, ErrEmailTaken)
+	}
+}
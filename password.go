@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// New passwords must satisfy the password policy: a minimum length, a mix
+// of character classes, not one of the user's last few passwords and not
+// on a list of passwords known from breaches. The policy is configured by:
+//
+//	PASSWORD_MIN_LENGTH      minimum length in characters (default 10)
+//	PASSWORD_MIN_CLASSES     how many of lower case, upper case, digits and
+//	                         symbols a password must mix (default 2)
+//	PASSWORD_HISTORY         how many recent passwords can't be reused
+//	                         (default 5; 0 allows reuse)
+//	BCRYPT_COST              bcrypt cost of new hashes (default 12)
+//	BREACHED_PASSWORDS_FILE  a file of SHA-1 hashes of breached passwords,
+//	                         one per line, checked on top of the bundled
+//	                         list; "HASH:COUNT" lines as in the Have I Been
+//	                         Pwned downloads are accepted
+//
+// Hashes made with a lower cost than BCRYPT_COST are upgraded when the user
+// next logs in.
+const (
+	defaultPasswordMinLength  = 10
+	defaultPasswordMinClasses = 2
+	defaultPasswordHistory    = 5
+	defaultBcryptCost         = 12
+
+	// maxPasswordLength is the most bcrypt can hash, in bytes.
+	maxPasswordLength = 72
+)
+
+//go:embed breached_passwords.txt
+var bundledBreachedPasswords string
+
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+	History    int
+	Cost       int
+
+	// breached holds the upper case hex SHA-1 hashes of breached passwords.
+	breached map[string]bool
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+}
+
+func defaultPasswordPolicy() *PasswordPolicy {
+	p := &PasswordPolicy{
+		MinLength:  defaultPasswordMinLength,
+		MinClasses: defaultPasswordMinClasses,
+		History:    defaultPasswordHistory,
+		Cost:       defaultBcryptCost,
+		breached:   map[string]bool{},
+	}
+	p.addBreached(strings.NewReader(bundledBreachedPasswords))
+	return p
+}
+
+// loadPasswordPolicy builds the configured policy. The numbers have been
+// validated with the rest of the configuration.
+func loadPasswordPolicy(cfg *Config) (*PasswordPolicy, error) {
+	p := defaultPasswordPolicy()
+	p.MinLength = cfg.PasswordMinLength
+	p.MinClasses = cfg.PasswordMinClasses
+	p.History = cfg.PasswordHistory
+	p.Cost = cfg.BcryptCost
+
+	if path := cfg.BreachedPasswordsFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := p.addBreached(f); err != nil {
+			return nil, fmt.Errorf("reading BREACHED_PASSWORDS_FILE: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// addBreached adds the hashes in r to the breached list. Blank lines and
+// lines starting with # are skipped.
+func (p *PasswordPolicy) addBreached(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		p.breached[strings.ToUpper(hash)] = true
+	}
+	return scanner.Err()
+}
+
+func (p *PasswordPolicy) isBreached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return p.breached[strings.ToUpper(hex.EncodeToString(sum[:]))]
+}
+
+// Validate checks a new password against the policy, apart from reuse.
+func (p *PasswordPolicy) Validate(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return newError(KindValidation, ErrWeakPassword.Code, fmt.Sprintf("password must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordLength {
+		return newError(KindValidation, ErrWeakPassword.Code, fmt.Sprintf("password must be at most %d bytes long", maxPasswordLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return newError(KindValidation, ErrWeakPassword.Code,
+			fmt.Sprintf("password must mix at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses))
+	}
+
+	if p.isBreached(password) {
+		return ErrBreachedPassword
+	}
+	return nil
+}
+
+// Hash hashes a password with the policy's cost.
+func (p *PasswordPolicy) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), p.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// Compare reports whether password is user's. user may be nil, in which
+// case a dummy hash is compared against, so unknown emails take as long to
+// reject as wrong passwords.
+func (p *PasswordPolicy) Compare(user *User, password string) bool {
+	if user == nil {
+		p.dummyHashOnce.Do(func() {
+			p.dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gobank-dummy-password"), p.Cost)
+		})
+		bcrypt.CompareHashAndPassword(p.dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
+
+// NeedsRehash reports whether hash was made with a lower cost than the
+// policy's.
+func (p *PasswordPolicy) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < p.Cost
+}
+
+// recordPassword adds user's current password to their history.
+func (s *APIServer) recordPassword(ctx context.Context, user *User) error {
+	return s.store.AddPasswordHistory(ctx, user.ID, user.Password, s.passwords.History)
+}
+
+// changePassword sets a new password for user and stores it, after checking
+// it against the policy and the user's recent passwords.
+func (s *APIServer) changePassword(ctx context.Context, user *User, password string) error {
+	if err := s.passwords.Validate(password); err != nil {
+		return err
+	}
+
+	if s.passwords.History > 0 {
+		previous, err := s.store.GetPasswordHistory(ctx, user.ID, s.passwords.History)
+		if err != nil {
+			return err
+		}
+		for _, hash := range append(previous, user.Password) {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+				return newError(KindValidation, ErrPasswordReused.Code,
+					fmt.Sprintf("password must differ from your last %d passwords", s.passwords.History))
+			}
+		}
+	}
+
+	hashed, err := s.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.SetPassword(ctx, user.ID, hashed); err != nil {
+		return err
+	}
+	user.Password = hashed
+	return s.recordPassword(ctx, user)
+}
+
+// upgradePasswordHash rehashes user's password with the current cost after
+// a successful login. Failing to is logged, not reported: the old hash
+// still works.
+func (s *APIServer) upgradePasswordHash(ctx context.Context, user *User, password string) {
+	if !s.passwords.NeedsRehash(user.Password) {
+		return
+	}
+
+	hashed, err := s.passwords.Hash(password)
+	if err != nil {
+		slog.Error("rehashing password failed", "user_id", user.ID, "err", err)
+		return
+	}
+	if err := s.store.SetPassword(ctx, user.ID, hashed); err != nil {
+		slog.Error("storing rehashed password failed", "user_id", user.ID, "err", err)
+		return
+	}
+	user.Password = hashed
+}
+
+// insertPasswordHistory is the shared SQL implementation of
+// Storage.AddPasswordHistory.
+func insertPasswordHistory(ctx context.Context, db *sql.DB, userID int, hash string, keep int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO password_history (user_id, password_hash, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP)`,
+		userID, hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM password_history WHERE user_id = $1 AND id NOT IN
+		(SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`, userID, keep)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func queryPasswordHistory(ctx context.Context, db *sql.DB, userID, limit int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2`,
+		userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ProfileUpdate holds the fields users can change about themselves. Nil
+// fields are left as they are.
+type ProfileUpdate struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+	Email     *string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// normalize trims the fields and lower-cases the email.
+func (u *ProfileUpdate) normalize() {
+	for _, field := range []*string{u.FirstName, u.LastName} {
+		if field != nil {
+			*field = strings.TrimSpace(*field)
+		}
+	}
+	if u.Email != nil {
+		*u.Email = normalizeEmail(*u.Email)
+	}
+}
+
+func (u *ProfileUpdate) validate() error {
+	v := new(validator)
+	if u.FirstName != nil {
+		v.name("firstName", *u.FirstName)
+	}
+	if u.LastName != nil {
+		v.name("lastName", *u.LastName)
+	}
+	if u.Email != nil {
+		v.email("email", *u.Email)
+	}
+	return v.err()
+}
+
+// GET /me returns the current user.
+func (s *APIServer) handleGetMe(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, currentUser(r))
+}
+
+// PATCH /me changes the current user's name or email. Only the fields in
+// the body are changed, and fields that can't be changed here, such as the
+// password, are rejected. A new email has to be verified again, and the old
+// address is told about the change.
+func (s *APIServer) handleUpdateMe(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	update := new(ProfileUpdate)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(update); err != nil {
+		return validationError("invalid request body: %v", err)
+	}
+
+	update.normalize()
+	if err := update.validate(); err != nil {
+		return err
+	}
+
+	user := currentUser(r)
+	if user.SystemKey != "" {
+		return ErrSystemUser
+	}
+	emailChanged := update.Email != nil && *update.Email != user.Email
+	if !emailChanged {
+		update.Email = nil
+	}
+
+	if err := s.store.UpdateUserProfile(ctx, user.ID, update); err != nil {
+		return err
+	}
+
+	updated, err := s.store.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		return fmt.Errorf("%w with ID: %d", ErrUserNotFound, user.ID)
+	}
+
+	if emailChanged {
+		if err := s.sendVerificationEmail(ctx, updated); err != nil {
+			slog.Error("sending verification email failed", "user_id", user.ID, "err", err)
+		}
+
+		body := fmt.Sprintf(`Hi %s,
+
+The email address of your GoBank account was changed to %s. If you didn't change it, reset your password and contact us.
+`, updated.FirstName, updated.Email)
+		if err := s.mailer.Send(user.Email, "Your GoBank email address was changed", body); err != nil {
+			slog.Error("sending email change notice failed", "user_id", user.ID, "err", err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, updated)
+}
+
+// POST /me/password changes the current user's password. The current
+// password is required, and wrong guesses count as failed logins. Every
+// session is ended, and the response starts a new one for this client.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	changeReq := new(ChangePasswordRequest)
+	if err := decodeJSON(r, changeReq); err != nil {
+		return err
+	}
+
+	user := currentUser(r)
+	if user.SystemKey != "" {
+		return ErrSystemUser
+	}
+	email, ip := normalizeEmail(user.Email), clientIP(r)
+	if err := s.checkLoginAllowed(ctx, w, email, ip); err != nil {
+		return err
+	}
+
+	v := new(validator)
+	if changeReq.CurrentPassword == "" {
+		v.add("currentPassword", FieldRequired, "currentPassword is required")
+	}
+	v.password("newPassword", changeReq.NewPassword, s.passwords)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	if !s.passwords.Compare(user, changeReq.CurrentPassword) {
+		if err := s.loginFailed(ctx, email, ip, user); err != nil {
+			return err
+		}
+		v.add("currentPassword", ErrIncorrectPassword.Code, ErrIncorrectPassword.Message)
+		return v.err()
+	}
+
+	if err := s.changePassword(ctx, user, changeReq.NewPassword); err != nil {
+		return err
+	}
+
+	if err := s.store.RevokeUserTokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	resp, err := s.issueTokens(ctx, user, "")
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// updateUserProfile is the shared SQL implementation of
+// Storage.UpdateUserProfile. It writes only the columns of the fields that
+// are set.
+func updateUserProfile(ctx context.Context, db *sql.DB, id int, update *ProfileUpdate) error {
+	var columns []userColumn
+	if update.FirstName != nil {
+		columns = append(columns, userColumn{"first_name", *update.FirstName})
+	}
+	if update.LastName != nil {
+		columns = append(columns, userColumn{"last_name", *update.LastName})
+	}
+	if update.Email != nil {
+		columns = append(columns, userColumn{"email", *update.Email}, userColumn{"email_verified", false})
+	}
+	return setUserColumns(ctx, db, id, columns...)
+}
+
+// userColumn is a column of the users table and the value to store in it.
+type userColumn struct {
+	name  string
+	value any
+}
+
+// setUserColumns writes only the given columns of a user. It is the shared
+// SQL implementation of UpdateUserProfile, SetPassword and the other
+// Storage methods that change single fields.
+func setUserColumns(ctx context.Context, db *sql.DB, id int, columns ...userColumn) error {
+	if len(columns) == 0 {
+		return nil
+	}
+
+	var sets strings.Builder
+	var args []any
+	for _, column := range columns {
+		args = append(args, column.value)
+		if sets.Len() > 0 {
+			sets.WriteString(", ")
+		}
+		fmt.Fprintf(&sets, "%s = $%d", column.name, len(args))
+	}
+
+	args = append(args, id)
+	res, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE users SET %s WHERE id = $%d`, sets.String(), len(args)), args...)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a Storage backed by a single SQLite file. It uses the same
+// schema as PostgresStore so local runs and integration tests exercise the
+// real SQL paths without a database server.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*SQLiteStore, error) {
+	// _txlock=immediate makes every transaction take the write lock up front,
+	// so the balance check in TransferFunds can't race another writer.
+	connStr := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", path)
+	db, err := sql.Open("sqlite3", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being split across connections.
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Init brings the schema up to date by applying any pending migrations.
+func (s *SQLiteStore) Init() error {
+	return s.migrator().Up()
+}
+
+func (s *SQLiteStore) migrator() *Migrator {
+	return newMigrator(s.db, sqliteMigrations)
+}
+
+// isSQLiteUniqueViolation reports whether err is a UNIQUE constraint failure.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func (s *SQLiteStore) CreateUser(ctx context.Context, user *User) error {
+	query := `INSERT INTO users (first_name, last_name, email, password, created_at, role, totp_secret, totp_enabled, email_verified,
+		system_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, '')) RETURNING id`
+	err := s.db.QueryRowContext(ctx, query, user.FirstName, user.LastName, user.Email, user.Password, user.CreatedAt, user.Role,
+		user.TOTPSecret, user.TOTPEnabled, user.EmailVerified, user.SystemKey).Scan(&user.ID)
+	if isSQLiteUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// DeleteUser removes a user together with their accounts. Accounts that
+// already have transactions keep the user from being deleted.
+func (s *SQLiteStore) DeleteUser(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hasPostings bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM postings p JOIN accounts a ON a.id = p.account_id WHERE a.user_id = $1)`, id).Scan(&hasPostings)
+	if err != nil {
+		return err
+	}
+	if hasPostings {
+		return fmt.Errorf("%w (user ID %d)", ErrUserHasTransactions, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from accounts where user_id = $1`, id); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		slog.Error("deleting user failed", "user_id", id, "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateUser(ctx context.Context, user *User) error {
+	query := `UPDATE users SET first_name = $1, last_name = $2, email = $3, password = $4, role = $5,
+		totp_secret = $6, totp_enabled = $7, email_verified = $8, system_key = NULLIF($9, '') WHERE id = $10`
+	_, err := s.db.ExecContext(ctx, query, user.FirstName, user.LastName, user.Email, user.Password, user.Role,
+		user.TOTPSecret, user.TOTPEnabled, user.EmailVerified, user.SystemKey, user.ID)
+	if isSQLiteUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No user found
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteStore) GetUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// CreateAccount inserts account, generating a unique account number unless
+// one is already set. A non-zero Balance is posted as an opening balance.
+func (s *SQLiteStore) CreateAccount(ctx context.Context, account *Account) error {
+	generate := account.Number == 0
+	for attempt := 1; ; attempt++ {
+		if generate {
+			number, err := newAccountNumber()
+			if err != nil {
+				return err
+			}
+			account.Number = number
+		}
+
+		err := insertAccount(ctx, s.db, account)
+		if generate && attempt < accountNumberAttempts && isSQLiteUniqueViolation(err) {
+			continue // number already taken, try another one
+		}
+		return err
+	}
+}
+
+// CloseAccount marks an account as closed. Only accounts with a zero balance
+// can be closed.
+func (s *SQLiteStore) CloseAccount(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	var status AccountStatus
+	err = tx.QueryRowContext(ctx, `SELECT balance, status FROM accounts WHERE id = $1`, id).Scan(&balance, &status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w with ID %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if status == AccountClosed {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, id)
+	}
+	if balance != 0 {
+		return fmt.Errorf("%w of %d (account ID %d)", ErrAccountNotEmpty, balance, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET status = $1 WHERE id = $2`, AccountClosed, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE id = $1`
+	account, err := scanAccount(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil // No account found
+	}
+	return account, err
+}
+
+func (s *SQLiteStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE number = $1`
+	account, err := scanAccount(s.db.QueryRowContext(ctx, query, number))
+	if err == sql.ErrNoRows {
+		return nil, nil // No account found
+	}
+	return account, err
+}
+
+func (s *SQLiteStore) GetAccountsByUser(ctx context.Context, userID int) ([]*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE user_id = $1 ORDER BY id ASC`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *SQLiteStore) TransferFunds(ctx context.Context, fromID, toID int64, amount int64) error {
+	if err := validateTransfer(fromID, toID, amount); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("starting transaction failed", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var fromBalance int64
+	var fromStatus AccountStatus
+	err = tx.QueryRowContext(ctx, `SELECT balance, status FROM accounts WHERE id = $1`, fromID).Scan(&fromBalance, &fromStatus)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, fromID)
+	}
+	if err != nil {
+		slog.Error("fetching sender account failed", "from_account_id", fromID, "err", err)
+		return err
+	}
+
+	if fromStatus != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, fromID)
+	}
+
+	var toStatus AccountStatus
+	err = tx.QueryRowContext(ctx, `SELECT status FROM accounts WHERE id = $1`, toID).Scan(&toStatus)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w (account ID %d)", ErrUnknownRecipient, toID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if toStatus != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, toID)
+	}
+
+	if fromBalance < amount {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, fromID)
+	}
+
+	_, err = postJournalEntry(ctx, tx, EntryTransfer, fmt.Sprintf("transfer from account %d to account %d", fromID, toID), []Posting{
+		{AccountID: int(fromID), Amount: -amount},
+		{AccountID: int(toID), Amount: amount},
+	})
+	if err != nil {
+		slog.Error("posting transfer failed", "from_account_id", fromID, "to_account_id", toID, "err", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) AdjustBalance(ctx context.Context, accountID int64, amount int64, description string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	var status AccountStatus
+	err = tx.QueryRowContext(ctx, `SELECT balance, status FROM accounts WHERE id = $1`, accountID).Scan(&balance, &status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, accountID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, accountID)
+	}
+	if balance+amount < 0 {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, accountID)
+	}
+
+	if err := postAdjustment(ctx, tx, int(accountID), amount, description); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE LOWER(email) = $1`, normalizeEmail(email)))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with email %s", ErrUserNotFound, email)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *SQLiteStore) GetBalance(ctx context.Context, accountID int) (int64, error) {
+	var balance int64
+	err := s.db.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1`, accountID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w with ID %d", ErrAccountNotFound, accountID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func (s *SQLiteStore) GetTransactions(ctx context.Context, accountID int) ([]Transaction, error) {
+	return queryTransactions(ctx, s.db, accountID)
+}
+
+func (s *SQLiteStore) GetJournalEntries(ctx context.Context, afterID, limit int) ([]*JournalEntry, error) {
+	return queryJournalEntries(ctx, s.db, afterID, limit)
+}
+
+func (s *SQLiteStore) ReconcileLedger(ctx context.Context) (*LedgerReport, error) {
+	return reconcileLedger(ctx, s.db)
+}
+
+func (s *SQLiteStore) ReserveIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	return reserveIdempotencyKey(ctx, s.db, record)
+}
+
+func (s *SQLiteStore) CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error {
+	return completeIdempotencyKey(ctx, s.db, record)
+}
+
+func (s *SQLiteStore) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	return deleteIdempotencyKey(ctx, s.db, userID, key)
+}
+
+func (s *SQLiteStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	return insertRefreshToken(ctx, s.db, token)
+}
+
+func (s *SQLiteStore) ConsumeRefreshToken(ctx context.Context, hash string) (*RefreshToken, bool, error) {
+	return consumeRefreshToken(ctx, s.db, hash)
+}
+
+func (s *SQLiteStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	return revokeRefreshTokens(ctx, s.db, "family_id", familyID)
+}
+
+func (s *SQLiteStore) RevokeUserTokens(ctx context.Context, userID int) error {
+	return revokeRefreshTokens(ctx, s.db, "user_id", userID)
+}
+
+func (s *SQLiteStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return revokeToken(ctx, s.db, jti, expiresAt)
+}
+
+func (s *SQLiteStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return isTokenRevoked(ctx, s.db, jti)
+}
+
+func (s *SQLiteStore) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	return useTOTPStep(ctx, s.db, userID, step)
+}
+
+func (s *SQLiteStore) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	return replaceRecoveryCodes(ctx, s.db, userID, hashes)
+}
+
+func (s *SQLiteStore) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	return useRecoveryCode(ctx, s.db, userID, hash)
+}
+
+func (s *SQLiteStore) CreateUserToken(ctx context.Context, token *UserToken) error {
+	return insertUserToken(ctx, s.db, token)
+}
+
+func (s *SQLiteStore) ConsumeUserToken(ctx context.Context, hash, purpose string) (int, error) {
+	return consumeUserToken(ctx, s.db, hash, purpose)
+}
+
+func (s *SQLiteStore) RecordLoginFailure(ctx context.Context, scope, subject string, at, since time.Time) (*LoginAttempts, error) {
+	return recordLoginFailure(ctx, s.db, scope, subject, at, since)
+}
+
+func (s *SQLiteStore) GetLoginAttempts(ctx context.Context, scope, subject string) (*LoginAttempts, error) {
+	return getLoginAttempts(ctx, s.db, scope, subject)
+}
+
+func (s *SQLiteStore) SetLoginLock(ctx context.Context, scope, subject string, until time.Time) error {
+	return setLoginLock(ctx, s.db, scope, subject, until)
+}
+
+func (s *SQLiteStore) ClearLoginFailures(ctx context.Context, scope, subject string) error {
+	return clearLoginFailures(ctx, s.db, scope, subject)
+}
+
+func (s *SQLiteStore) CreateLockout(ctx context.Context, lockout *Lockout) error {
+	return insertLockout(ctx, s.db, lockout)
+}
+
+func (s *SQLiteStore) GetLockouts(ctx context.Context, limit int) ([]*Lockout, error) {
+	return queryLockouts(ctx, s.db, limit)
+}
+
+func (s *SQLiteStore) GetLockout(ctx context.Context, id int) (*Lockout, error) {
+	return getLockout(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) UnlockLogin(ctx context.Context, scope, subject string, unlockedBy int) error {
+	return unlockLogin(ctx, s.db, scope, subject, unlockedBy)
+}
+
+func (s *SQLiteStore) AddPasswordHistory(ctx context.Context, userID int, hash string, keep int) error {
+	return insertPasswordHistory(ctx, s.db, userID, hash, keep)
+}
+
+func (s *SQLiteStore) GetPasswordHistory(ctx context.Context, userID, limit int) ([]string, error) {
+	return queryPasswordHistory(ctx, s.db, userID, limit)
+}
+
+func (s *SQLiteStore) UpdateUserProfile(ctx context.Context, id int, update *ProfileUpdate) error {
+	err := updateUserProfile(ctx, s.db, id, update)
+	if isSQLiteUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetUserBySystemKey(ctx context.Context, key string) (*User, error) {
+	return getUserBySystemKey(ctx, s.db, key)
+}
+
+func (s *SQLiteStore) EnsureSystemAccount(ctx context.Context, key string) (*Account, error) {
+	return ensureSystemAccount(ctx, s.db, key)
+}
+
+func (s *SQLiteStore) SetPassword(ctx context.Context, id int, hash string) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"password", hash})
+}
+
+func (s *SQLiteStore) SetTOTP(ctx context.Context, id int, secret string, enabled bool) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"totp_secret", secret}, userColumn{"totp_enabled", enabled})
+}
+
+func (s *SQLiteStore) SetEmailVerified(ctx context.Context, id int, verified bool) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"email_verified", verified})
+}
+
+func (s *SQLiteStore) SetRole(ctx context.Context, id int, role Role) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"role", role})
+}
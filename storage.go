@@ -1,31 +1,123 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Storage interface {
-	CreateUser(*User) error
-	DeleteUser(int) error
-	UpdateUser(*User) error
-	GetUsers() ([]*User, error)
-	GetUserByID(int) (*User, error)
-	GetUserByEmail(string) (*User, error)
-	TransferFunds(fromID int64, toID int64, amount int64) error
-	GetBalance(id int) (int64, error)
-	GetTransactions(id int) ([]Transaction, error)
+	CreateUser(context.Context, *User) error
+	DeleteUser(context.Context, int) error
+	UpdateUser(context.Context, *User) error
+	// UpdateUserProfile changes only the fields set in update. Changing the
+	// email marks it as unverified.
+	UpdateUserProfile(ctx context.Context, id int, update *ProfileUpdate) error
+	// SetPassword, SetTOTP, SetEmailVerified and SetRole change only the
+	// named fields, so concurrent requests can't undo each other's changes
+	// the way UpdateUser, which writes every field, can.
+	SetPassword(ctx context.Context, id int, hash string) error
+	SetTOTP(ctx context.Context, id int, secret string, enabled bool) error
+	SetEmailVerified(ctx context.Context, id int, verified bool) error
+	SetRole(ctx context.Context, id int, role Role) error
+	GetUsers(ctx context.Context) ([]*User, error)
+	GetUserByID(context.Context, int) (*User, error)
+	GetUserByEmail(context.Context, string) (*User, error)
+	// GetUserBySystemKey returns the system user with the given key, or nil
+	// if there is none.
+	GetUserBySystemKey(ctx context.Context, key string) (*User, error)
+	CreateAccount(context.Context, *Account) error
+	CloseAccount(ctx context.Context, id int) error
+	GetAccountByID(ctx context.Context, id int) (*Account, error)
+	GetAccountByNumber(ctx context.Context, number int64) (*Account, error)
+	GetAccountsByUser(ctx context.Context, userID int) ([]*Account, error)
+	// EnsureSystemAccount returns the system account with the given key,
+	// creating it if it doesn't exist and reopening it if it was closed.
+	EnsureSystemAccount(ctx context.Context, key string) (*Account, error)
+	TransferFunds(ctx context.Context, fromAccountID int64, toAccountID int64, amount int64) error
+	// AdjustBalance credits or debits an account against the mint. It
+	// fails with ErrInsufficientFunds if the balance would go negative.
+	AdjustBalance(ctx context.Context, accountID int64, amount int64, description string) error
+	GetBalance(ctx context.Context, accountID int) (int64, error)
+	GetTransactions(ctx context.Context, accountID int) ([]Transaction, error)
+	GetJournalEntries(ctx context.Context, afterID, limit int) ([]*JournalEntry, error)
+	ReconcileLedger(ctx context.Context) (*LedgerReport, error)
+
+	// ReserveIdempotencyKey stores record as pending. If the user already
+	// has an unexpired record with the same key, nothing is stored and that
+	// record is returned instead.
+	ReserveIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, userID int, key string) error
+
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	// ConsumeRefreshToken marks the refresh token with the given hash as
+	// used and returns it, or nil if there is no such token. reused is true
+	// if the token had already been used or revoked.
+	ConsumeRefreshToken(ctx context.Context, hash string) (token *RefreshToken, reused bool, err error)
+	// RevokeTokenFamily ends a session: it revokes its refresh tokens and
+	// the access tokens issued with them.
+	RevokeTokenFamily(ctx context.Context, familyID string) error
+	// RevokeUserTokens ends every session of a user.
+	RevokeUserTokens(ctx context.Context, userID int) error
+	// RevokeToken puts an access token on the revocation list until it
+	// expires.
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+
+	// UseTOTPStep records that the user's TOTP code for step was used. It
+	// returns false if that step or a later one was used already.
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	// ReplaceRecoveryCodes replaces the user's recovery codes, given as
+	// hashes. No hashes removes them all.
+	ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used. It returns
+	// false if the user has no such unused code.
+	UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error)
+
+	// CreateUserToken stores an email verification or password reset
+	// token, replacing the user's earlier token for the same purpose.
+	CreateUserToken(ctx context.Context, token *UserToken) error
+	// ConsumeUserToken deletes the unexpired token with the given hash and
+	// purpose and returns its user ID, or 0 if there is no such token.
+	ConsumeUserToken(ctx context.Context, hash, purpose string) (int, error)
+
+	// RecordLoginFailure counts a failed login for scope and subject and
+	// returns the new count. Failures before since are forgotten.
+	RecordLoginFailure(ctx context.Context, scope, subject string, at, since time.Time) (*LoginAttempts, error)
+	// GetLoginAttempts returns the failure count for scope and subject, or
+	// nil if there is none.
+	GetLoginAttempts(ctx context.Context, scope, subject string) (*LoginAttempts, error)
+	SetLoginLock(ctx context.Context, scope, subject string, until time.Time) error
+	ClearLoginFailures(ctx context.Context, scope, subject string) error
+	CreateLockout(ctx context.Context, lockout *Lockout) error
+	GetLockouts(ctx context.Context, limit int) ([]*Lockout, error)
+	// GetLockout returns the lockout with the given ID, or nil if there is
+	// none.
+	GetLockout(ctx context.Context, id int) (*Lockout, error)
+	// UnlockLogin clears the failures for scope and subject and marks their
+	// active lockouts as lifted by unlockedBy.
+	UnlockLogin(ctx context.Context, scope, subject string, unlockedBy int) error
+
+	// AddPasswordHistory records a password hash of the user and keeps only
+	// their keep most recent ones.
+	AddPasswordHistory(ctx context.Context, userID int, hash string, keep int) error
+	// GetPasswordHistory returns the user's most recent password hashes,
+	// newest first.
+	GetPasswordHistory(ctx context.Context, userID, limit int) ([]string, error)
 }
 
 type PostgresStore struct {
 	db *sql.DB
 }
 
-func newPostGresStore() (*PostgresStore, error) {
-	connStr := "user=postgres dbname=postgres password=gobank sslmode=disable"
+func newPostGresStore(connStr string) (*PostgresStore, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -40,98 +132,106 @@ func newPostGresStore() (*PostgresStore, error) {
 	}, nil
 }
 
+// Close closes the connection pool. Queries still running are allowed to
+// finish first.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// Init brings the schema up to date by applying any pending migrations.
 func (s *PostgresStore) Init() error {
-	if err := s.createUsersTable(); err != nil {
-		return err
-	}
-	if err := s.createTransactionsTable(); err != nil {
-		return err
-	}
-	return nil
+	return s.migrator().Up()
 }
 
-func (s *PostgresStore) createUsersTable() error {
-	query := `create table if not exists users (
-		id serial primary key,
-		first_name varchar(50),
-		last_name varchar(50),
-		email varchar(100) unique not null,
-		password varchar(100) not null,
-		created_at timestamp,
-		balance BIGINT DEFAULT 100
-	)`
-	_, err := s.db.Exec(query)
-	return err
+func (s *PostgresStore) migrator() *Migrator {
+	return newMigrator(s.db, postgresMigrations)
 }
 
-func (s *PostgresStore) createTransactionsTable() error {
-	query := `CREATE TABLE IF NOT EXISTS transactions (
-        id SERIAL PRIMARY KEY,
-        user_id INTEGER NOT NULL,
-        amount INTEGER NOT NULL,
-        type VARCHAR(50) NOT NULL,
-        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY (user_id) REFERENCES users(id)
-    )`
+// isPostgresUniqueViolation reports whether err is a unique constraint
+// violation (SQLSTATE 23505).
+func isPostgresUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
 
-	_, err := s.db.Exec(query)
+func (s *PostgresStore) CreateUser(ctx context.Context, user *User) error {
+	query := `INSERT INTO users (first_name, last_name, email, password, created_at, role, totp_secret, totp_enabled, email_verified,
+		system_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, '')) RETURNING id`
+	err := s.db.QueryRowContext(ctx, query, user.FirstName, user.LastName, user.Email, user.Password, user.CreatedAt, user.Role,
+		user.TOTPSecret, user.TOTPEnabled, user.EmailVerified, user.SystemKey).Scan(&user.ID)
+	if isPostgresUniqueViolation(err) {
+		return ErrEmailTaken
+	}
 	return err
 }
 
-func (s *PostgresStore) CreateUser(user *User) error {
-	log.Printf("Original (already hashed) password: %s", user.Password)
+// DeleteUser removes a user together with their accounts. Accounts that
+// already have transactions keep the user from being deleted.
+func (s *PostgresStore) DeleteUser(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	log.Printf("Creating user with email: %s", user.Email)
-	log.Printf("Hashed password to be stored: %s", user.Password)
+	var hasPostings bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM postings p JOIN accounts a ON a.id = p.account_id WHERE a.user_id = $1)`, id).Scan(&hasPostings)
+	if err != nil {
+		return err
+	}
+	if hasPostings {
+		return fmt.Errorf("%w (user ID %d)", ErrUserHasTransactions, id)
+	}
 
-	query := `INSERT INTO users (first_name, last_name, email, password, created_at, balance) VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err := s.db.Exec(query, user.FirstName, user.LastName, user.Email, user.Password, user.CreatedAt, user.Balance)
-	return err
-}
+	if _, err := tx.ExecContext(ctx, `delete from accounts where user_id = $1`, id); err != nil {
+		slog.Error("deleting accounts of user failed", "user_id", id, "err", err)
+		return err
+	}
 
-func (s *PostgresStore) DeleteUser(id int) error {
 	query := `delete from users where id = $1`
-	result, err := s.db.Exec(query, id)
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
-		log.Printf("Error deleting user with ID %d: %v", id, err)
+		slog.Error("deleting user failed", "user_id", id, "err", err)
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Error getting rows affected for user ID %d: %v", id, err)
+		slog.Error("getting rows affected failed", "user_id", id, "err", err)
 		return err
 	}
 
 	if rowsAffected == 0 {
-		log.Printf("No user found with ID %d", id)
-		return fmt.Errorf("no user found with ID %d", id)
+		return fmt.Errorf("%w with ID %d", ErrUserNotFound, id)
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (s *PostgresStore) UpdateUser(user *User) error {
-	query := `UPDATE users SET first_name = $1, last_name = $2, email = $3, password = $4, balance = $5 WHERE id = $6`
-	_, err := s.db.Exec(query, user.FirstName, user.LastName, user.Email, user.Password, user.Balance, user.ID)
+func (s *PostgresStore) UpdateUser(ctx context.Context, user *User) error {
+	query := `UPDATE users SET first_name = $1, last_name = $2, email = $3, password = $4, role = $5,
+		totp_secret = $6, totp_enabled = $7, email_verified = $8, system_key = NULLIF($9, '') WHERE id = $10`
+	_, err := s.db.ExecContext(ctx, query, user.FirstName, user.LastName, user.Email, user.Password, user.Role,
+		user.TOTPSecret, user.TOTPEnabled, user.EmailVerified, user.SystemKey, user.ID)
+	if isPostgresUniqueViolation(err) {
+		return ErrEmailTaken
+	}
 	return err
 }
 
-func (s *PostgresStore) GetUserByID(id int) (*User, error) {
-	query := `SELECT id, first_name, last_name, email, password, created_at, balance FROM users WHERE id = $1`
-	var user User
-	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.CreatedAt, &user.Balance)
+func (s *PostgresStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No user found
 		}
 		return nil, err // Other error
 	}
-	return &user, nil
+	return user, nil
 }
 
-func (s *PostgresStore) GetUsers() ([]*User, error) {
-	rows, err := s.db.Query("SELECT * FROM users ORDER BY id ASC")
+func (s *PostgresStore) GetUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY id ASC`)
 	if err != nil {
 		return nil, err
 	}
@@ -139,121 +239,441 @@ func (s *PostgresStore) GetUsers() ([]*User, error) {
 
 	users := []*User{}
 	for rows.Next() {
-		user := new(User)
-		err := rows.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.CreatedAt, &user.Balance)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
 
-func (s *PostgresStore) TransferFunds(fromID, toID int64, amount int64) error {
-	log.Printf("Starting transfer: From ID %d to ID %d, Amount: %d", fromID, toID, amount)
+// CreateAccount inserts account, generating a unique account number unless
+// one is already set. A non-zero Balance is posted as an opening balance.
+func (s *PostgresStore) CreateAccount(ctx context.Context, account *Account) error {
+	generate := account.Number == 0
+	for attempt := 1; ; attempt++ {
+		if generate {
+			number, err := newAccountNumber()
+			if err != nil {
+				return err
+			}
+			account.Number = number
+		}
+
+		err := insertAccount(ctx, s.db, account)
+		if generate && attempt < accountNumberAttempts && isPostgresUniqueViolation(err) {
+			continue // number already taken, try another one
+		}
+		return err
+	}
+}
 
-	tx, err := s.db.Begin()
+// CloseAccount marks an account as closed. Only accounts with a zero balance
+// can be closed.
+func (s *PostgresStore) CloseAccount(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
 		return err
 	}
 	defer tx.Rollback()
 
-	var fromBalance int64
-	err = tx.QueryRow(`SELECT balance FROM users WHERE id = $1`, fromID).Scan(&fromBalance)
+	var balance int64
+	var status AccountStatus
+	err = tx.QueryRowContext(ctx, `SELECT balance, status FROM accounts WHERE id = $1 FOR UPDATE`, id).Scan(&balance, &status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w with ID %d", ErrAccountNotFound, id)
+	}
 	if err != nil {
-		log.Printf("Error fetching sender balance: %v", err)
 		return err
 	}
-	log.Printf("Sender (ID: %d) balance: %d", fromID, fromBalance)
 
-	if fromBalance < amount {
-		log.Printf("Insufficient funds: Balance %d, Amount %d", fromBalance, amount)
-		return fmt.Errorf("insufficient funds in account ID %d", fromID)
+	if status == AccountClosed {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, id)
+	}
+	if balance != 0 {
+		return fmt.Errorf("%w of %d (account ID %d)", ErrAccountNotEmpty, balance, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET status = $1 WHERE id = $2`, AccountClosed, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE id = $1`
+	account, err := scanAccount(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil // No account found
+	}
+	return account, err
+}
+
+func (s *PostgresStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE number = $1`
+	account, err := scanAccount(s.db.QueryRowContext(ctx, query, number))
+	if err == sql.ErrNoRows {
+		return nil, nil // No account found
+	}
+	return account, err
+}
+
+func (s *PostgresStore) GetAccountsByUser(ctx context.Context, userID int) ([]*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE user_id = $1 ORDER BY id ASC`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// userColumns is the column list read by scanUser.
+const userColumns = `id, first_name, last_name, email, password, created_at, role, totp_secret, totp_enabled,
+	email_verified, COALESCE(system_key, '')`
+
+// scanUser reads the columns listed in userColumns.
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	user := new(User)
+	err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.CreatedAt, &user.Role,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.EmailVerified, &user.SystemKey)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// accountColumns is the column list read by scanAccount.
+const accountColumns = `id, COALESCE(user_id, 0), type, COALESCE(number, 0), balance, status, created_at, COALESCE(system_key, '')`
+
+// scanAccount reads the columns listed in accountColumns.
+func scanAccount(row interface{ Scan(...any) error }) (*Account, error) {
+	account := new(Account)
+	err := row.Scan(&account.ID, &account.UserID, &account.Type, &account.Number, &account.Balance, &account.Status, &account.CreatedAt, &account.SystemKey)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// insertAccount stores account and posts its opening balance, if any, in a
+// single transaction. It is shared by the SQL stores.
+func insertAccount(ctx context.Context, db *sql.DB, account *Account) error {
+	if account.Balance < 0 {
+		return validationError("opening balance cannot be negative")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec(`UPDATE users SET balance = balance - $1 WHERE id = $2`, amount, fromID)
+	query := `INSERT INTO accounts (user_id, type, number, balance, status, created_at) VALUES ($1, $2, $3, 0, $4, $5) RETURNING id`
+	err = tx.QueryRowContext(ctx, query, account.UserID, account.Type, account.Number, account.Status, account.CreatedAt).Scan(&account.ID)
 	if err != nil {
-		log.Printf("Error updating sender balance: %v", err)
 		return err
 	}
 
-	_, err = tx.Exec(`UPDATE users SET balance = balance + $1 WHERE id = $2`, amount, toID)
+	if account.Balance != 0 {
+		if err := postOpeningBalance(ctx, tx, account.ID, account.Balance); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockAccounts takes row locks on the given accounts in ascending ID order
+// and returns the locked rows by ID. Accounts that don't exist are missing
+// from the result.
+func lockAccounts(ctx context.Context, tx *sql.Tx, ids ...int64) (map[int64]*Account, error) {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	locked := map[int64]*Account{}
+	for _, id := range sorted {
+		if _, ok := locked[id]; ok {
+			continue
+		}
+
+		account, err := scanAccount(tx.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id = $1 FOR UPDATE`, id))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		locked[id] = account
+	}
+	return locked, nil
+}
+
+func (s *PostgresStore) TransferFunds(ctx context.Context, fromID, toID int64, amount int64) error {
+	if err := validateTransfer(fromID, toID, amount); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("Error updating recipient balance: %v", err)
+		slog.Error("starting transaction failed", "err", err)
 		return err
 	}
+	defer tx.Rollback()
 
-	//insert transaction records:
-	_, err = tx.Exec(`INSERT INTO transactions (user_id, amount, type) VALUES ($1, $2, $3)`, fromID, -amount, "Sent")
+	// Lock both rows before reading them, always in ascending ID order, so
+	// concurrent transfers can't both spend the same balance and opposite
+	// transfers between the same accounts can't deadlock.
+	locked, err := lockAccounts(ctx, tx, fromID, toID)
 	if err != nil {
-		log.Printf("Error inserting sender transaction: %v", err)
+		slog.Error("locking accounts failed", "from_account_id", fromID, "to_account_id", toID, "err", err)
 		return err
 	}
 
-	_, err = tx.Exec(`INSERT INTO transactions (user_id, amount, type) VALUES ($1, $2, $3)`, toID, amount, "Received")
+	from, ok := locked[fromID]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, fromID)
+	}
+	fromBalance := from.Balance
+
+	if from.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, fromID)
+	}
+
+	to, ok := locked[toID]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrUnknownRecipient, toID)
+	}
+
+	if to.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, toID)
+	}
+
+	if fromBalance < amount {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, fromID)
+	}
+
+	_, err = postJournalEntry(ctx, tx, EntryTransfer, fmt.Sprintf("transfer from account %d to account %d", fromID, toID), []Posting{
+		{AccountID: int(fromID), Amount: -amount},
+		{AccountID: int(toID), Amount: amount},
+	})
 	if err != nil {
-		log.Printf("Error inserting recipient transaction: %v", err)
+		slog.Error("posting transfer failed", "from_account_id", fromID, "to_account_id", toID, "err", err)
 		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		log.Printf("Error committing transaction: %v", err)
+		slog.Error("committing transfer failed", "from_account_id", fromID, "to_account_id", toID, "err", err)
 		return err
 	}
 
-	log.Println("Transfer completed successfully")
 	return nil
 }
 
-func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
-	query := `SELECT id, first_name, last_name, email, password, created_at FROM users WHERE email = $1`
+func (s *PostgresStore) AdjustBalance(ctx context.Context, accountID int64, amount int64, description string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	var user User
-	err := s.db.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.FirstName,
-		&user.LastName,
-		&user.Email,
-		&user.Password,
-		&user.CreatedAt,
-	)
+	locked, err := lockAccounts(ctx, tx, accountID)
+	if err != nil {
+		return err
+	}
 
+	account, ok := locked[accountID]
+	if !ok {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountNotFound, accountID)
+	}
+	if account.Status != AccountOpen {
+		return fmt.Errorf("%w (account ID %d)", ErrAccountClosed, accountID)
+	}
+	if account.Balance+amount < 0 {
+		return fmt.Errorf("%w (account ID %d)", ErrInsufficientFunds, accountID)
+	}
+
+	if err := postAdjustment(ctx, tx, int(accountID), amount, description); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE LOWER(email) = $1`, normalizeEmail(email)))
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with email %s", ErrUserNotFound, email)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Retrieved user from database - Email: %s, Hashed Password: %s", user.Email, user.Password)
-
-	return &user, nil
+	return user, nil
 }
 
-func (s *PostgresStore) GetBalance(id int) (int64, error) {
+func (s *PostgresStore) GetBalance(ctx context.Context, accountID int) (int64, error) {
 	var balance int64
-	err := s.db.QueryRow("SELECT balance FROM users WHERE id = $1", id).Scan(&balance)
+	err := s.db.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE id = $1", accountID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w with ID %d", ErrAccountNotFound, accountID)
+	}
 	if err != nil {
 		return 0, err
 	}
 	return balance, nil
 }
 
-func (s *PostgresStore) GetTransactions(id int) ([]Transaction, error) {
-	rows, err := s.db.Query("SELECT id, amount, type, created_at FROM transactions WHERE user_id = $1", id)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+func (s *PostgresStore) GetTransactions(ctx context.Context, accountID int) ([]Transaction, error) {
+	return queryTransactions(ctx, s.db, accountID)
+}
 
-	var transactions []Transaction
-	for rows.Next() {
-		var t Transaction
-		err := rows.Scan(&t.ID, &t.Amount, &t.Type, &t.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		transactions = append(transactions, t)
+func (s *PostgresStore) GetJournalEntries(ctx context.Context, afterID, limit int) ([]*JournalEntry, error) {
+	return queryJournalEntries(ctx, s.db, afterID, limit)
+}
+
+func (s *PostgresStore) ReconcileLedger(ctx context.Context) (*LedgerReport, error) {
+	return reconcileLedger(ctx, s.db)
+}
+
+func (s *PostgresStore) ReserveIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	return reserveIdempotencyKey(ctx, s.db, record)
+}
+
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error {
+	return completeIdempotencyKey(ctx, s.db, record)
+}
+
+func (s *PostgresStore) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	return deleteIdempotencyKey(ctx, s.db, userID, key)
+}
+
+func (s *PostgresStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	return insertRefreshToken(ctx, s.db, token)
+}
+
+func (s *PostgresStore) ConsumeRefreshToken(ctx context.Context, hash string) (*RefreshToken, bool, error) {
+	return consumeRefreshToken(ctx, s.db, hash)
+}
+
+func (s *PostgresStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	return revokeRefreshTokens(ctx, s.db, "family_id", familyID)
+}
+
+func (s *PostgresStore) RevokeUserTokens(ctx context.Context, userID int) error {
+	return revokeRefreshTokens(ctx, s.db, "user_id", userID)
+}
+
+func (s *PostgresStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return revokeToken(ctx, s.db, jti, expiresAt)
+}
+
+func (s *PostgresStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return isTokenRevoked(ctx, s.db, jti)
+}
+
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	return useTOTPStep(ctx, s.db, userID, step)
+}
+
+func (s *PostgresStore) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	return replaceRecoveryCodes(ctx, s.db, userID, hashes)
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	return useRecoveryCode(ctx, s.db, userID, hash)
+}
+
+func (s *PostgresStore) CreateUserToken(ctx context.Context, token *UserToken) error {
+	return insertUserToken(ctx, s.db, token)
+}
+
+func (s *PostgresStore) ConsumeUserToken(ctx context.Context, hash, purpose string) (int, error) {
+	return consumeUserToken(ctx, s.db, hash, purpose)
+}
+
+func (s *PostgresStore) RecordLoginFailure(ctx context.Context, scope, subject string, at, since time.Time) (*LoginAttempts, error) {
+	return recordLoginFailure(ctx, s.db, scope, subject, at, since)
+}
+
+func (s *PostgresStore) GetLoginAttempts(ctx context.Context, scope, subject string) (*LoginAttempts, error) {
+	return getLoginAttempts(ctx, s.db, scope, subject)
+}
+
+func (s *PostgresStore) SetLoginLock(ctx context.Context, scope, subject string, until time.Time) error {
+	return setLoginLock(ctx, s.db, scope, subject, until)
+}
+
+func (s *PostgresStore) ClearLoginFailures(ctx context.Context, scope, subject string) error {
+	return clearLoginFailures(ctx, s.db, scope, subject)
+}
+
+func (s *PostgresStore) CreateLockout(ctx context.Context, lockout *Lockout) error {
+	return insertLockout(ctx, s.db, lockout)
+}
+
+func (s *PostgresStore) GetLockouts(ctx context.Context, limit int) ([]*Lockout, error) {
+	return queryLockouts(ctx, s.db, limit)
+}
+
+func (s *PostgresStore) GetLockout(ctx context.Context, id int) (*Lockout, error) {
+	return getLockout(ctx, s.db, id)
+}
+
+func (s *PostgresStore) UnlockLogin(ctx context.Context, scope, subject string, unlockedBy int) error {
+	return unlockLogin(ctx, s.db, scope, subject, unlockedBy)
+}
+
+func (s *PostgresStore) AddPasswordHistory(ctx context.Context, userID int, hash string, keep int) error {
+	return insertPasswordHistory(ctx, s.db, userID, hash, keep)
+}
+
+func (s *PostgresStore) GetPasswordHistory(ctx context.Context, userID, limit int) ([]string, error) {
+	return queryPasswordHistory(ctx, s.db, userID, limit)
+}
+
+func (s *PostgresStore) UpdateUserProfile(ctx context.Context, id int, update *ProfileUpdate) error {
+	err := updateUserProfile(ctx, s.db, id, update)
+	if isPostgresUniqueViolation(err) {
+		return ErrEmailTaken
 	}
-	return transactions, nil
+	return err
+}
+
+func (s *PostgresStore) GetUserBySystemKey(ctx context.Context, key string) (*User, error) {
+	return getUserBySystemKey(ctx, s.db, key)
+}
+
+func (s *PostgresStore) EnsureSystemAccount(ctx context.Context, key string) (*Account, error) {
+	return ensureSystemAccount(ctx, s.db, key)
+}
+
+func (s *PostgresStore) SetPassword(ctx context.Context, id int, hash string) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"password", hash})
+}
+
+func (s *PostgresStore) SetTOTP(ctx context.Context, id int, secret string, enabled bool) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"totp_secret", secret}, userColumn{"totp_enabled", enabled})
+}
+
+func (s *PostgresStore) SetEmailVerified(ctx context.Context, id int, verified bool) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"email_verified", verified})
+}
+
+func (s *PostgresStore) SetRole(ctx context.Context, id int, role Role) error {
+	return setUserColumns(ctx, s.db, id, userColumn{"role", role})
 }
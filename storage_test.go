@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// forEachStore runs test against every Storage backend available: the
+// memory store, SQLite in a temporary file and, if GOBANK_TEST_DATABASE_URL
+// is set, Postgres.
+func forEachStore(t *testing.T, test func(t *testing.T, store Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newTestStore(t, newMemoryStore()))
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := newSQLiteStore(filepath.Join(t.TempDir(), "gobank.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, newTestStore(t, store))
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("GOBANK_TEST_DATABASE_URL")
+		if dsn == "" {
+			t.Skip("GOBANK_TEST_DATABASE_URL is not set")
+		}
+		store, err := newPostGresStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, newTestStore(t, store))
+	})
+}
+
+// newTestStore migrates store, creates the mint and closes the store when
+// the test ends.
+func newTestStore(t *testing.T, store Storage) Storage {
+	t.Helper()
+	t.Cleanup(func() { closeStore(store) })
+
+	if s, ok := store.(interface{ Init() error }); ok {
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.EnsureSystemAccount(context.Background(), mintSystemKey); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newTestUser stores a verified customer. The email is unique, so tests can
+// share a Postgres database.
+func newTestUser(t *testing.T, store Storage, name string) *User {
+	t.Helper()
+	email := fmt.Sprintf("%s.%d@example.com", name, time.Now().UnixNano())
+	user := NewUser(name, "Test", email, "")
+	user.EmailVerified = true
+	if err := store.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func newTestAccount(t *testing.T, store Storage, userID int, balance int64) *Account {
+	t.Helper()
+	account := NewAccount(userID, AccountChecking)
+	account.Balance = balance
+	if err := store.CreateAccount(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func balanceOf(t *testing.T, store Storage, accountID int) int64 {
+	t.Helper()
+	balance, err := store.GetBalance(context.Background(), accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// TestConcurrentTransfers sends many transfers in both directions between
+// the same two accounts at once. Money must neither appear nor disappear,
+// no balance may go negative and opposite transfers must not deadlock.
+func TestConcurrentTransfers(t *testing.T) {
+	const (
+		workers   = 8 // per direction
+		transfers = 40
+		opening   = 1000
+	)
+
+	forEachStore(t, func(t *testing.T, store Storage) {
+		a := newTestAccount(t, store, newTestUser(t, store, "alice").ID, opening)
+		b := newTestAccount(t, store, newTestUser(t, store, "bob").ID, opening)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var succeeded, insufficient atomic.Int64
+		errs := make(chan error, 2*workers)
+		var wg sync.WaitGroup
+		for w := 0; w < 2*workers; w++ {
+			from, to := a, b
+			if w%2 == 1 {
+				from, to = b, a
+			}
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(seed))
+				for i := 0; i < transfers; i++ {
+					amount := rng.Int63n(300) + 1
+					err := store.TransferFunds(ctx, int64(from.ID), int64(to.ID), amount)
+					switch {
+					case err == nil:
+						succeeded.Add(1)
+					case errors.Is(err, ErrInsufficientFunds):
+						insufficient.Add(1)
+					default:
+						errs <- fmt.Errorf("transfer %d -> %d of %d: %w", from.ID, to.ID, amount, err)
+						return
+					}
+				}
+			}(int64(w))
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Minute):
+			cancel()
+			t.Fatal("transfers did not finish; they are probably deadlocked")
+		}
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		balanceA, balanceB := balanceOf(t, store, a.ID), balanceOf(t, store, b.ID)
+		if balanceA < 0 || balanceB < 0 {
+			t.Errorf("negative balance: %d and %d", balanceA, balanceB)
+		}
+		if total := balanceA + balanceB; total != 2*opening {
+			t.Errorf("total balance is %d after transfers, want %d", total, 2*opening)
+		}
+		if succeeded.Load() == 0 {
+			t.Error("no transfer succeeded")
+		}
+
+		report, err := store.ReconcileLedger(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Balanced {
+			t.Errorf("ledger does not reconcile: %+v", report)
+		}
+		t.Logf("%d transfers succeeded, %d were refused for insufficient funds", succeeded.Load(), insufficient.Load())
+	})
+}
+
+// TestConcurrentTransfersDrainingOneAccount has every worker try to spend
+// the same balance. Exactly as many transfers succeed as the balance
+// covers.
+func TestConcurrentTransfersDrainingOneAccount(t *testing.T) {
+	const (
+		workers = 20
+		opening = 10
+	)
+
+	forEachStore(t, func(t *testing.T, store Storage) {
+		from := newTestAccount(t, store, newTestUser(t, store, "spender").ID, opening)
+		to := newTestAccount(t, store, newTestUser(t, store, "payee").ID, 0)
+
+		var succeeded atomic.Int64
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.TransferFunds(context.Background(), int64(from.ID), int64(to.ID), 1)
+				switch {
+				case err == nil:
+					succeeded.Add(1)
+				case !errors.Is(err, ErrInsufficientFunds):
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := succeeded.Load(); got != opening {
+			t.Errorf("%d transfers succeeded, want %d", got, opening)
+		}
+		if balance := balanceOf(t, store, from.ID); balance != 0 {
+			t.Errorf("sender balance is %d, want 0", balance)
+		}
+		if balance := balanceOf(t, store, to.ID); balance != opening {
+			t.Errorf("recipient balance is %d, want %d", balance, opening)
+		}
+	})
+}
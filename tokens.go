@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A login starts a session: a short-lived access token (a JWT sent as the
+// bearer token) and a refresh token that is exchanged for a new pair when
+// the access token expires. Refresh tokens rotate: each one can be used
+// once, and presenting a used one again revokes the whole session, since it
+// means the token was stolen.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// RefreshToken is a stored refresh token. Only the hash of the token is
+// kept. FamilyID identifies the session every rotation of the token belongs
+// to, and AccessJTI the access token that was issued with it, so revoking a
+// session can revoke its access tokens too.
+type RefreshToken struct {
+	TokenHash       string
+	UserID          int
+	FamilyID        string
+	AccessJTI       string
+	AccessExpiresAt time.Time
+	CreatedAt       time.Time
+	ExpiresAt       time.Time
+	RevokedAt       *time.Time
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newTokenID returns a random identifier for tokens and sessions.
+func newTokenID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access and refresh token for user. An empty
+// familyID starts a new session.
+func (s *APIServer) issueTokens(ctx context.Context, user *User, familyID string) (*LoginResponse, error) {
+	if familyID == "" {
+		id, err := newTokenID()
+		if err != nil {
+			return nil, err
+		}
+		familyID = id
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now().UTC()
+	accessExpiresAt := now.Add(accessTokenTTL)
+	accessToken, err := s.createJWT(user, jti, familyID, accessExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.CreateRefreshToken(ctx, &RefreshToken{
+		TokenHash:       hashRefreshToken(refreshToken),
+		UserID:          user.ID,
+		FamilyID:        familyID,
+		AccessJTI:       jti,
+		AccessExpiresAt: accessExpiresAt,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		User:         user,
+	}, nil
+}
+
+// POST /token/refresh exchanges a refresh token for a new token pair.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	refreshReq := new(RefreshRequest)
+	if err := decodeJSON(r, refreshReq); err != nil {
+		return err
+	}
+	if refreshReq.RefreshToken == "" {
+		return validationError("refreshToken is required")
+	}
+
+	token, reused, err := s.store.ConsumeRefreshToken(ctx, hashRefreshToken(refreshReq.RefreshToken))
+	if err != nil {
+		return err
+	}
+	if token == nil || token.ExpiresAt.Before(s.now()) {
+		return fmt.Errorf("%w: unknown or expired refresh token", ErrInvalidToken)
+	}
+	if reused {
+		if err := s.store.RevokeTokenFamily(ctx, token.FamilyID); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: refresh token was already used or revoked", ErrTokenRevoked)
+	}
+
+	user, err := s.store.GetUserByID(ctx, token.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w: user no longer exists", ErrInvalidToken)
+	}
+	if user.SystemKey != "" {
+		return fmt.Errorf("%w: system users can't log in", ErrInvalidToken)
+	}
+
+	resp, err := s.issueTokens(ctx, user, token.FamilyID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// POST /logout ends the current session.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := currentClaims(r)
+	if err := s.store.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+	if err := s.store.RevokeTokenFamily(ctx, claims.SessionID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// POST /logout/all ends every session of the current user.
+func (s *APIServer) handleLogoutAll(w http.ResponseWriter, r *http.Request) error {
+	if err := s.store.RevokeUserTokens(r.Context(), currentUser(r).ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DELETE /users/{id}/sessions ends every session of a user, e.g. after
+// their account was compromised. Admins only.
+func (s *APIServer) handleRevokeUserSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	if err := requirePermission(r, PermManageUsers); err != nil {
+		return err
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid user ID: %s", idStr)
+	}
+
+	user, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w with ID: %d", ErrUserNotFound, id)
+	}
+
+	if err := s.store.RevokeUserTokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// insertRefreshToken is the shared SQL implementation of
+// Storage.CreateRefreshToken. It also drops expired refresh tokens.
+func insertRefreshToken(ctx context.Context, db *sql.DB, token *RefreshToken) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1`, token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `INSERT INTO refresh_tokens
+		(token_hash, user_id, family_id, access_jti, access_expires_at, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		token.TokenHash, token.UserID, token.FamilyID, token.AccessJTI, token.AccessExpiresAt, token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+// consumeRefreshToken marks a refresh token as used. The update only
+// succeeds once, so two concurrent refreshes can't both rotate the token.
+func consumeRefreshToken(ctx context.Context, db *sql.DB, hash string) (*RefreshToken, bool, error) {
+	res, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE token_hash = $2 AND revoked_at IS NULL`,
+		time.Now().UTC(), hash)
+	if err != nil {
+		return nil, false, err
+	}
+	consumed, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	token := &RefreshToken{}
+	var revokedAt sql.NullTime
+	err = db.QueryRowContext(ctx, `SELECT token_hash, user_id, family_id, access_jti, access_expires_at, created_at, expires_at, revoked_at
+		FROM refresh_tokens WHERE token_hash = $1`, hash).
+		Scan(&token.TokenHash, &token.UserID, &token.FamilyID, &token.AccessJTI, &token.AccessExpiresAt,
+			&token.CreatedAt, &token.ExpiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+
+	return token, consumed == 0, nil
+}
+
+// revokeRefreshTokens revokes the refresh tokens matching column = value
+// and puts the access tokens issued with them on the revocation list.
+func revokeRefreshTokens(ctx context.Context, db *sql.DB, column string, value any) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, `INSERT INTO revoked_tokens (jti, expires_at)
+		SELECT access_jti, access_expires_at FROM refresh_tokens WHERE `+column+` = $1 AND access_expires_at > $2
+		ON CONFLICT (jti) DO NOTHING`, value, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE `+column+` = $2 AND revoked_at IS NULL`, now, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeToken puts an access token on the revocation list until it expires
+// and drops entries for tokens that have expired since.
+func revokeToken(ctx context.Context, db *sql.DB, jti string, expiresAt time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < $1`, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt.UTC())
+	return err
+}
+
+func isTokenRevoked(ctx context.Context, db *sql.DB, jti string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`, jti).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Two-factor authentication uses time-based one-time passwords (RFC 6238)
+// with the parameters every authenticator app supports: HMAC-SHA1, 6 digits
+// and a 30 second period. A code is accepted one period either side of the
+// current one to allow for clock drift, and never twice.
+const (
+	totpIssuer  = "GoBank"
+	totpDigits  = 6
+	totpPeriod  = 30 * time.Second
+	totpSkew    = 1
+	totpKeySize = 20
+
+	recoveryCodeCount = 10
+
+	// mfaTokenTTL is how long the user has to enter their code after
+	// entering their password.
+	mfaTokenTTL      = 5 * time.Minute
+	mfaTokenAudience = "gobank:mfa"
+
+	// defaultTOTPTransferThreshold is used when TOTP_TRANSFER_THRESHOLD is
+	// not set. Users with two-factor authentication enabled must send a code
+	// with any transfer above it.
+	defaultTOTPTransferThreshold = 100000
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	key := make([]byte, totpKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// totpStep returns the number of the period t falls in.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode computes the code for a step (RFC 4226 section 5.3).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("decoding TOTP secret: %w", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTP returns the step code was generated for, if it is valid at t.
+func matchTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps import, usually by
+// scanning it as a QR code.
+func totpURI(secret, email string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(int(totpPeriod/time.Second)))
+
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// generateRecoveryCodes returns single-use codes that stand in for a TOTP
+// code at login when the user has lost their authenticator.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return hashes
+}
+
+// verifyTOTP checks a code from the user's authenticator and uses it up, so
+// the same code can't be replayed.
+func (s *APIServer) verifyTOTP(ctx context.Context, user *User, code string) error {
+	if code == "" {
+		return ErrTOTPRequired
+	}
+
+	step, ok := matchTOTP(user.TOTPSecret, code, s.now())
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+
+	fresh, err := s.store.UseTOTPStep(ctx, user.ID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return fmt.Errorf("%w: code was already used", ErrInvalidTOTPCode)
+	}
+	return nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func (s *APIServer) verifySecondFactor(ctx context.Context, user *User, code, recoveryCode string) error {
+	if recoveryCode == "" {
+		return s.verifyTOTP(ctx, user, code)
+	}
+
+	ok, err := s.store.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(recoveryCode))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: unknown or used recovery code", ErrInvalidTOTPCode)
+	}
+	return nil
+}
+
+// mfaClaims identify a user who has entered their password but not yet
+// their second factor. The audience keeps them from being accepted as
+// access tokens, and the jti is revoked once the login completes.
+type mfaClaims struct {
+	UserID int `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+func (s *APIServer) createMFAToken(user *User) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := s.now()
+	return s.keys.sign(mfaClaims{
+		UserID: user.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Audience:  jwt.ClaimStrings{mfaTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+		},
+	})
+}
+
+func (s *APIServer) validateMFAToken(ctx context.Context, tokenString string) (*mfaClaims, error) {
+	claims := &mfaClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc,
+		jwt.WithExpirationRequired(), jwt.WithAudience(mfaTokenAudience), jwt.WithTimeFunc(s.now))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	revoked, err := s.store.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// MFAChallenge is the login response for users with two-factor
+// authentication. MFAToken is exchanged for a session at /login/totp.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+	ExpiresIn   int    `json:"expiresIn"`
+}
+
+type LoginTOTPRequest struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// POST /login/totp completes a login with a TOTP or recovery code.
+func (s *APIServer) handleLoginTOTP(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	loginReq := new(LoginTOTPRequest)
+	if err := decodeJSON(r, loginReq); err != nil {
+		return err
+	}
+
+	claims, err := s.validateMFAToken(ctx, loginReq.MFAToken)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.store.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.SystemKey != "" || !user.TOTPEnabled {
+		return fmt.Errorf("%w: two-factor authentication is not enabled", ErrInvalidToken)
+	}
+
+	// Wrong codes count as failed logins, so codes can't be guessed by
+	// fetching new MFA tokens.
+	email, ip := normalizeEmail(user.Email), clientIP(r)
+	if err := s.checkLoginAllowed(ctx, w, email, ip); err != nil {
+		return err
+	}
+	if err := s.verifySecondFactor(ctx, user, loginReq.Code, loginReq.RecoveryCode); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			if err := s.loginFailed(ctx, email, ip, user); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	// The MFA token is single-use
+	if err := s.store.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+	if err := s.store.ClearLoginFailures(ctx, ScopeAccount, email); err != nil {
+		return err
+	}
+
+	resp, err := s.issueTokens(ctx, user, "")
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// POST /me/totp starts enrollment with a new secret. Two-factor
+// authentication is only enabled once a code from it has been confirmed.
+func (s *APIServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	user := currentUser(r)
+	if user.TOTPEnabled {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.SetTOTP(r.Context(), user.ID, secret, false); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, TOTPEnrollment{Secret: secret, URI: totpURI(secret, user.Email)})
+}
+
+// POST /me/totp/confirm enables two-factor authentication and returns the
+// recovery codes. They are only ever shown here.
+func (s *APIServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := currentUser(r)
+	if user.TOTPEnabled {
+		return ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return fmt.Errorf("%w: start enrollment first", ErrTOTPNotEnabled)
+	}
+
+	codeReq := new(TOTPCodeRequest)
+	if err := decodeJSON(r, codeReq); err != nil {
+		return err
+	}
+	if err := s.verifyTOTP(ctx, user, codeReq.Code); err != nil {
+		return err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, hashRecoveryCodes(codes)); err != nil {
+		return err
+	}
+
+	// The secret that was just verified is stored with the flag, in case
+	// another enrollment replaced it in the meantime
+	if err := s.store.SetTOTP(ctx, user.ID, user.TOTPSecret, true); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DELETE /me/totp turns two-factor authentication off. It takes a current
+// code, so a stolen session alone can't remove the second factor.
+func (s *APIServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := currentUser(r)
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	codeReq := new(TOTPCodeRequest)
+	if err := decodeJSON(r, codeReq); err != nil {
+		return err
+	}
+	if err := s.verifySecondFactor(ctx, user, codeReq.Code, codeReq.RecoveryCode); err != nil {
+		return err
+	}
+
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, nil); err != nil {
+		return err
+	}
+
+	if err := s.store.SetTOTP(ctx, user.ID, "", false); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// POST /me/totp/recovery-codes replaces the recovery codes with new ones.
+func (s *APIServer) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := currentUser(r)
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	codeReq := new(TOTPCodeRequest)
+	if err := decodeJSON(r, codeReq); err != nil {
+		return err
+	}
+	if err := s.verifyTOTP(ctx, user, codeReq.Code); err != nil {
+		return err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, hashRecoveryCodes(codes)); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// useTOTPStep is the shared SQL implementation of Storage.UseTOTPStep. The
+// conditional update makes concurrent uses of the same code race safely.
+func useTOTPStep(ctx context.Context, db *sql.DB, userID int, step int64) (bool, error) {
+	res, err := db.ExecContext(ctx, `UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func replaceRecoveryCodes(ctx context.Context, db *sql.DB, userID int, hashes []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func useRecoveryCode(ctx context.Context, db *sql.DB, userID int, hash string) (bool, error) {
+	res, err := db.ExecContext(ctx, `UPDATE recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`,
+		time.Now().UTC(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key from RFC 6238 appendix B,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// testClock is a fixed clock for APIServer.now.
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTOTPTestServer returns a server on a fixed clock whose user has
+// two-factor authentication enabled with the RFC 6238 secret.
+func newTOTPTestServer(t *testing.T) (*APIServer, *testClock, *User) {
+	t.Helper()
+	keys, err := loadKeySet(&Config{JWTSecret: strings.Repeat("x", minSecretLength)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t, newMemoryStore())
+	clock := &testClock{t: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}
+	s := NewAPIServer(":0", store, keys)
+	s.now = clock.now
+
+	user := newTestUser(t, store, "totp")
+	user.TOTPSecret = rfc6238Secret
+	user.TOTPEnabled = true
+	if err := store.SetTOTP(context.Background(), user.ID, user.TOTPSecret, true); err != nil {
+		t.Fatal(err)
+	}
+	return s, clock, user
+}
+
+func codeAt(t *testing.T, at time.Time) string {
+	t.Helper()
+	code, err := totpCode(rfc6238Secret, totpStep(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8-digit codes; 6-digit codes are their last six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := codeAt(t, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// Authenticator apps may show the secret in lower case.
+	code, err := totpCode(strings.ToLower(rfc6238Secret), totpStep(time.Unix(59, 0)))
+	if err != nil || code != "287082" {
+		t.Errorf("lower-case secret gave %q, %v", code, err)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestMatchTOTPSkewWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := totpStep(now)
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, err := totpCode(rfc6238Secret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := matchTOTP(rfc6238Secret, code, now)
+		if want := offset >= -totpSkew && offset <= totpSkew; ok != want {
+			t.Errorf("code from step %+d: accepted = %t, want %t", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code from step %+d matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	code := codeAt(t, now)
+	if _, ok := matchTOTP(rfc6238Secret, " "+code+" ", now); !ok {
+		t.Error("code with surrounding spaces was rejected")
+	}
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := matchTOTP(rfc6238Secret, bad, now); ok {
+			t.Errorf("code %q was accepted", bad)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	s, clock, user := newTOTPTestServer(t)
+	ctx := context.Background()
+
+	if err := s.verifyTOTP(ctx, user, ""); !errors.Is(err, ErrTOTPRequired) {
+		t.Fatalf("empty code: got %v, want %v", err, ErrTOTPRequired)
+	}
+
+	code := codeAt(t, clock.now())
+	if err := s.verifyTOTP(ctx, user, code); err != nil {
+		t.Fatalf("fresh code: %v", err)
+	}
+	if err := s.verifyTOTP(ctx, user, code); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("replayed code: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+
+	// The code is still inside the skew window one period later, but it
+	// has been used.
+	clock.advance(totpPeriod)
+	if err := s.verifyTOTP(ctx, user, code); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("replayed code in the next period: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+	if err := s.verifyTOTP(ctx, user, codeAt(t, clock.now())); err != nil {
+		t.Fatalf("code for the next period: %v", err)
+	}
+
+	clock.advance(2 * totpPeriod)
+	if err := s.verifyTOTP(ctx, user, code); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expired code: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	s, _, user := newTOTPTestServer(t)
+	ctx := context.Background()
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, hashRecoveryCodes(codes)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes are accepted however the user types them, but only once.
+	typed := " " + strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")) + " "
+	if err := s.verifySecondFactor(ctx, user, "", typed); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.verifySecondFactor(ctx, user, "", codes[0]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("second use: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+
+	if err := s.verifySecondFactor(ctx, user, "", codes[1]); err != nil {
+		t.Fatalf("another code: %v", err)
+	}
+	if err := s.verifySecondFactor(ctx, user, "", "aaaaa-bbbbb"); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("unknown code: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+
+	// Replacing the codes invalidates the old ones.
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, hashRecoveryCodes([]string{"fresh-code1"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifySecondFactor(ctx, user, "", codes[2]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("replaced code: got %v, want %v", err, ErrInvalidTOTPCode)
+	}
+}
+
+// transferFunc posts a transfer with a TOTP code and returns the status
+// and error code of the response.
+type transferFunc func(amount int64, code string) (int, string)
+
+// newTransferFunc funds an account of user and returns a transferFunc that
+// sends money from it, as user, to a new account of another user.
+func newTransferFunc(t *testing.T, s *APIServer, user *User) (transferFunc, *Account) {
+	t.Helper()
+	from := newTestAccount(t, s.store, user.ID, 10*s.totpTransferThreshold)
+	to := newTestAccount(t, s.store, newTestUser(t, s.store, "payee").ID, 0)
+
+	tokens, err := s.issueTokens(context.Background(), user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.routes()
+
+	return func(amount int64, code string) (int, string) {
+		t.Helper()
+		body, _ := json.Marshal(TransferRequest{
+			FromAccountID: int64(from.ID),
+			ToAccountID:   int64(to.ID),
+			Amount:        amount,
+			TOTPCode:      code,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var apiErr ApiError
+		_ = json.Unmarshal(rec.Body.Bytes(), &apiErr)
+		return rec.Code, apiErr.Code
+	}, to
+}
+
+func TestTransferAboveThresholdRequiresFreshTOTP(t *testing.T) {
+	s, clock, user := newTOTPTestServer(t)
+	transfer, to := newTransferFunc(t, s, user)
+
+	large := s.totpTransferThreshold + 1
+	if status, code := transfer(large, ""); status != http.StatusForbidden || code != "totp_required" {
+		t.Fatalf("without a code: got %d %q, want 403 totp_required", status, code)
+	}
+	if status, code := transfer(large, "000000"); status != http.StatusUnauthorized || code != "invalid_totp_code" {
+		t.Fatalf("with a wrong code: got %d %q, want 401 invalid_totp_code", status, code)
+	}
+
+	code := codeAt(t, clock.now())
+	if status, errCode := transfer(large, code); status != http.StatusOK {
+		t.Fatalf("with a fresh code: got %d %q, want 200", status, errCode)
+	}
+	if status, errCode := transfer(large, code); status != http.StatusUnauthorized || errCode != "invalid_totp_code" {
+		t.Fatalf("with a used code: got %d %q, want 401 invalid_totp_code", status, errCode)
+	}
+
+	clock.advance(totpPeriod)
+	if status, errCode := transfer(large, codeAt(t, clock.now())); status != http.StatusOK {
+		t.Fatalf("with the next period's code: got %d %q, want 200", status, errCode)
+	}
+
+	// Transfers up to the threshold don't need a code.
+	if status, errCode := transfer(s.totpTransferThreshold, ""); status != http.StatusOK {
+		t.Fatalf("at the threshold: got %d %q, want 200", status, errCode)
+	}
+
+	if balance := balanceOf(t, s.store, to.ID); balance != 2*large+s.totpTransferThreshold {
+		t.Errorf("recipient balance is %d, want %d", balance, 2*large+s.totpTransferThreshold)
+	}
+}
+
+// TestTransferTOTPGuessesAreThrottled guesses codes for a large transfer.
+// Wrong codes count as failed logins, so the guesses are slowed down and
+// then locked out, even for the right code.
+func TestTransferTOTPGuessesAreThrottled(t *testing.T) {
+	s, clock, user := newTOTPTestServer(t)
+	transfer, _ := newTransferFunc(t, s, user)
+	large := s.totpTransferThreshold + 1
+	policy := loginPolicies[ScopeAccount]
+
+	wrongCode := func() string {
+		code := []byte(codeAt(t, clock.now()))
+		code[0] = '0' + (code[0]-'0'+5)%10
+		return string(code)
+	}
+
+	for failures := 1; failures <= policy.LockoutAfter; failures++ {
+		if status, code := transfer(large, wrongCode()); status != http.StatusUnauthorized || code != "invalid_totp_code" {
+			t.Fatalf("guess %d: got %d %q, want 401 invalid_totp_code", failures, status, code)
+		}
+
+		delay, _ := policy.delay(failures)
+		if delay == 0 {
+			continue
+		}
+		if status, code := transfer(large, wrongCode()); status != http.StatusTooManyRequests || code != "too_many_login_attempts" {
+			t.Fatalf("guess during the backoff after %d failures: got %d %q, want 429", failures, status, code)
+		}
+		if failures < policy.LockoutAfter {
+			clock.advance(delay)
+		}
+	}
+
+	if status, code := transfer(large, codeAt(t, clock.now())); status != http.StatusTooManyRequests || code != "too_many_login_attempts" {
+		t.Fatalf("right code while locked out: got %d %q, want 429", status, code)
+	}
+	attempts, err := s.store.GetLoginAttempts(context.Background(), ScopeAccount, normalizeEmail(user.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts == nil || attempts.LockedUntil == nil || !attempts.LockedUntil.After(clock.now()) {
+		t.Fatalf("account is not locked: %+v", attempts)
+	}
+
+	// Transfers that need no code aren't affected.
+	if status, code := transfer(s.totpTransferThreshold, ""); status != http.StatusOK {
+		t.Fatalf("small transfer while locked out: got %d %q, want 200", status, code)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+// validateTransfer checks the parts of a transfer that don't need the
+// accounts themselves. Every store runs it before touching any rows.
+func validateTransfer(fromID, toID, amount int64) error {
+	if amount <= 0 {
+		return ErrInvalidAmount
+	}
+	if fromID == toID {
+		return ErrSelfTransfer
+	}
+	return nil
+}
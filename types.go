@@ -2,33 +2,79 @@ package main
 
 import (
 	"time"
+)
+
+type OpenAccountRequest struct {
+	Type AccountType `json:"type"`
+}
+
+type AccountType string
+
+const (
+	AccountChecking AccountType = "checking"
+	AccountSavings  AccountType = "savings"
+
+	// AccountSystem accounts belong to the bank itself rather than a user.
+	AccountSystem AccountType = "system"
+)
+
+func (t AccountType) Valid() bool {
+	return t == AccountChecking || t == AccountSavings
+}
+
+type AccountStatus string
+
+const (
+	AccountOpen   AccountStatus = "open"
+	AccountClosed AccountStatus = "closed"
+)
+
+// Account holds a balance owned by a User. A user can have several accounts
+// of different types, each with an independent balance. Number is the
+// customer-facing identifier; it is assigned by the store on creation.
+// System accounts have no user and are identified by SystemKey instead.
+type Account struct {
+	ID        int           `json:"id"`
+	UserID    int           `json:"userId"`
+	Type      AccountType   `json:"type"`
+	Number    int64         `json:"number"`
+	Balance   int64         `json:"balance"`
+	Status    AccountStatus `json:"status"`
+	CreatedAt time.Time     `json:"createdAt"`
+	SystemKey string        `json:"systemKey,omitempty"`
+}
 
-	"golang.org/x/crypto/bcrypt"
+func NewAccount(userID int, accountType AccountType) *Account {
+	return &Account{
+		UserID:    userID,
+		Type:      accountType,
+		Status:    AccountOpen,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Role decides what a user may do beyond managing their own accounts.
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+
+	// RoleTeller works the counter: they can look up any customer, adjust
+	// balances and close accounts, but not manage users.
+	RoleTeller Role = "teller"
+
+	// RoleAuditor can read everything, including the ledger, and change
+	// nothing but their own accounts.
+	RoleAuditor Role = "auditor"
+
+	// RoleAdmin can see and manage every user and account.
+	RoleAdmin Role = "admin"
 )
 
-type CreateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-}
-
-// type Account struct {
-// 	ID        int       `json:"id"`
-// 	FirstName string    `json:"firstName"`
-// 	LastName  string    `json:"lastName"`
-// 	Number    int64     `json:"number"`
-// 	Balance   int64     `json:"balance"`
-// 	CreatedAt time.Time `json:"createdAt"`
-// 	UserID    *int      `json:"userId"` // Added UserID to link to User
-// }
-
-// func NewAccount(firstName, LastName string) *Account {
-// 	return &Account{
-// 		FirstName: firstName,
-// 		LastName:  LastName,
-// 		Number:    int64(rand.Intn(1000000)),
-// 		CreatedAt: time.Now().UTC(),
-// 	}
-// }
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
 
 type User struct {
 	ID        int       `json:"id"`
@@ -37,26 +83,41 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  string    `json:"-"` // The "-" means this field won't be included in JSON output
 	CreatedAt time.Time `json:"createdAt"`
-	Balance   int64     `json:"balance"` // This can represent the account balance
-	Number    int64     `json:"number"`  // This can represent the account number
+	Role      Role      `json:"role"`
+
+	// TOTPSecret is the base32 secret of the user's authenticator app. It is
+	// set on enrollment and only used once TOTPEnabled is true.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+
+	// EmailVerified is set once the user has followed the link mailed to
+	// them. Unverified users can't send transfers.
+	EmailVerified bool `json:"emailVerified"`
+
+	// SystemKey marks users the bank creates for itself, such as the
+	// Monopoly Bank. They are managed through the configuration, not
+	// through the self-service endpoints customers use.
+	SystemKey string `json:"systemKey,omitempty"`
 }
 
-func NewUser(firstName, lastName, email, password string) (*User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, err
-	}
+// NewUser returns a new customer. hashedPassword comes from
+// PasswordPolicy.Hash.
+func NewUser(firstName, lastName, email, hashedPassword string) *User {
 	return &User{
 		FirstName: firstName,
 		LastName:  lastName,
 		Email:     email,
-		Password:  string(hashedPassword),
+		Password:  hashedPassword,
 		CreatedAt: time.Now().UTC(),
-	}, nil
+		Role:      RoleCustomer,
+	}
 }
 
+// Transaction is a posting as seen by the account holder.
 type Transaction struct {
 	ID        int       `json:"id"`
+	AccountID int       `json:"accountId"`
+	EntryID   int       `json:"entryId"`
 	Amount    int64     `json:"amount"`
 	Type      string    `json:"type"`
 	CreatedAt time.Time `json:"createdAt"`
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Column limits of the users table.
+const (
+	maxNameLength  = 50
+	maxEmailLength = 100
+)
+
+// FieldError says what is wrong with one field of a request. Code is one
+// of the field codes below, or an error code from errors.go such as
+// weak_password.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	FieldRequired     = "required"
+	FieldTooLong      = "too_long"
+	FieldInvalidEmail = "invalid_email"
+)
+
+// validator collects the field errors of a request.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, code, message string) {
+	v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// err returns the collected field errors as one ErrValidationFailed, or
+// nil if there are none.
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &Error{
+		Kind:    ErrValidationFailed.Kind,
+		Code:    ErrValidationFailed.Code,
+		Message: ErrValidationFailed.Message,
+		Fields:  v.fields,
+	}
+}
+
+// name checks a required name that must fit its column.
+func (v *validator) name(field, value string) {
+	switch {
+	case value == "":
+		v.add(field, FieldRequired, field+" is required")
+	case utf8.RuneCountInString(value) > maxNameLength:
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d characters", field, maxNameLength))
+	}
+}
+
+// email checks a required email address. Only the plain address form is
+// accepted, without a display name.
+func (v *validator) email(field, value string) {
+	switch {
+	case value == "":
+		v.add(field, FieldRequired, field+" is required")
+	case len(value) > maxEmailLength:
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d characters", field, maxEmailLength))
+	default:
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Address != value || !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+			v.add(field, FieldInvalidEmail, field+" is not a valid email address")
+		}
+	}
+}
+
+// password checks a new password against the policy.
+func (v *validator) password(field, value string, policy *PasswordPolicy) {
+	if value == "" {
+		v.add(field, FieldRequired, field+" is required")
+		return
+	}
+	var policyErr *Error
+	if err := policy.Validate(value); errors.As(err, &policyErr) {
+		v.add(field, policyErr.Code, policyErr.Message)
+	}
+}
+
+// normalizeEmail returns the form emails are stored and compared in.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// lowercaseEmails lowers every stored email. It runs as a migration step
+// for both SQL backends. Users whose emails differ only in case can't be
+// told apart by a lookup, and which of them should keep the address is not
+// for a migration to decide, so it fails and lists them instead. Change or
+// delete all but one user of each group and migrate again.
+func lowercaseEmails(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT LOWER(email), id FROM users WHERE LOWER(email) IN
+		(SELECT LOWER(email) FROM users GROUP BY LOWER(email) HAVING COUNT(*) > 1)
+		ORDER BY LOWER(email), id`)
+	if err != nil {
+		return err
+	}
+
+	var clashes [][]string
+	last := ""
+	for rows.Next() {
+		var email string
+		var id int
+		if err := rows.Scan(&email, &id); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(clashes) == 0 || email != last {
+			clashes = append(clashes, nil)
+			last = email
+		}
+		clashes[len(clashes)-1] = append(clashes[len(clashes)-1], strconv.Itoa(id))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(clashes) > 0 {
+		// IDs rather than emails, since the error ends up in the log
+		groups := make([]string, len(clashes))
+		for i, ids := range clashes {
+			groups[i] = strings.Join(ids, ", ")
+		}
+		return fmt.Errorf("users whose emails differ only in case must be resolved first; user IDs: %s",
+			strings.Join(groups, "; "))
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email = LOWER(email) WHERE email <> LOWER(email)`)
+	return err
+}
+
+// normalize trims the fields and lower-cases the email.
+func (req *CreateUserRequest) normalize() {
+	req.FirstName = strings.TrimSpace(req.FirstName)
+	req.LastName = strings.TrimSpace(req.LastName)
+	req.Email = normalizeEmail(req.Email)
+}
+
+// validateCreateUser normalizes a registration and checks every field.
+func (s *APIServer) validateCreateUser(req *CreateUserRequest) error {
+	req.normalize()
+
+	v := new(validator)
+	v.name("firstName", req.FirstName)
+	v.name("lastName", req.LastName)
+	v.email("email", req.Email)
+	v.password("password", req.Password, s.passwords)
+	return v.err()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Email verification and password reset both work by mailing the user a
+// link with a random token. Tokens are single-use, expire, and are stored
+// only as hashes. Requesting a new one invalidates the previous one.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+
+	verifyEmailTokenTTL   = 48 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+
+	// defaultAppURL is where the frontend runs; links in emails point to it.
+	defaultAppURL = "http://localhost:3001"
+)
+
+// UserToken is a stored email verification or password reset token.
+type UserToken struct {
+	TokenHash string
+	UserID    int
+	Purpose   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// createUserToken stores a new token for user and returns it.
+func (s *APIServer) createUserToken(ctx context.Context, user *User, purpose string, ttl time.Duration) (string, error) {
+	token, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := s.now().UTC()
+	err = s.store.CreateUserToken(ctx, &UserToken{
+		TokenHash: hashRefreshToken(token),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeUserToken uses up a token and returns the user it was issued to.
+func (s *APIServer) consumeUserToken(ctx context.Context, token, purpose string) (*User, error) {
+	if token == "" {
+		return nil, validationError("token is required")
+	}
+
+	userID, err := s.store.ConsumeUserToken(ctx, hashRefreshToken(token), purpose)
+	if err != nil {
+		return nil, err
+	}
+	if userID == 0 {
+		return nil, ErrInvalidLink
+	}
+
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrInvalidLink
+	}
+	return user, nil
+}
+
+func (s *APIServer) appLink(path, token string) string {
+	return s.appURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendVerificationEmail mails user a link to verify their email address.
+func (s *APIServer) sendVerificationEmail(ctx context.Context, user *User) error {
+	token, err := s.createUserToken(ctx, user, TokenVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm your email address by opening this link:
+
+%s
+
+The link expires in 48 hours. If you didn't sign up for GoBank, you can ignore this email.
+`, user.FirstName, s.appLink("/verify-email", token))
+
+	return s.mailer.Send(user.Email, "Confirm your GoBank email address", body)
+}
+
+// POST /verify-email marks the email address the token was sent to as
+// verified.
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	verifyReq := new(VerifyEmailRequest)
+	if err := decodeJSON(r, verifyReq); err != nil {
+		return err
+	}
+
+	user, err := s.consumeUserToken(ctx, verifyReq.Token, TokenVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.SetEmailVerified(ctx, user.ID, true); err != nil {
+		return err
+	}
+	user.EmailVerified = true
+
+	return WriteJSON(w, http.StatusOK, user)
+}
+
+// POST /me/verification-email sends a new verification link.
+func (s *APIServer) handleResendVerificationEmail(w http.ResponseWriter, r *http.Request) error {
+	user := currentUser(r)
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	if err := s.sendVerificationEmail(r.Context(), user); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// POST /password-reset mails a reset link if a user has the email address.
+// The response is the same either way, so it can't be used to find out
+// which addresses have accounts.
+func (s *APIServer) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	resetReq := new(PasswordResetRequest)
+	if err := decodeJSON(r, resetReq); err != nil {
+		return err
+	}
+
+	// System users' passwords come from the configuration
+	user, err := s.store.GetUserByEmail(ctx, resetReq.Email)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && user.SystemKey != "") {
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := s.createUserToken(ctx, user, TokenResetPassword, resetPasswordTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password of your GoBank account. To choose a new password, open this link:
+
+%s
+
+The link expires in an hour and works once. If you didn't ask for this, you can ignore this email; your password hasn't changed.
+`, user.FirstName, s.appLink("/reset-password", token))
+
+	if err := s.mailer.Send(user.Email, "Reset your GoBank password", body); err != nil {
+		slog.Error("sending password reset email failed", "user_id", user.ID, "err", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// POST /password-reset/confirm sets a new password and ends every session,
+// in case the old password was compromised. Following the link also proves
+// the user owns the email address.
+func (s *APIServer) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	confirmReq := new(PasswordResetConfirmRequest)
+	if err := decodeJSON(r, confirmReq); err != nil {
+		return err
+	}
+	// Check the policy before using up the link, so a rejected password
+	// can be retried.
+	if err := s.passwords.Validate(confirmReq.Password); err != nil {
+		return err
+	}
+
+	user, err := s.consumeUserToken(ctx, confirmReq.Token, TokenResetPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := s.changePassword(ctx, user, confirmReq.Password); err != nil {
+		return err
+	}
+	if err := s.store.SetEmailVerified(ctx, user.ID, true); err != nil {
+		return err
+	}
+
+	if err := s.store.RevokeUserTokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// insertUserToken is the shared SQL implementation of
+// Storage.CreateUserToken. It replaces the user's earlier tokens for the
+// same purpose and drops expired tokens.
+func insertUserToken(ctx context.Context, db *sql.DB, token *UserToken) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_tokens WHERE (user_id = $1 AND purpose = $2) OR expires_at < $3`,
+		token.UserID, token.Purpose, token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		token.TokenHash, token.UserID, token.Purpose, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// consumeUserToken deletes an unexpired token and returns its user ID, or 0
+// if there is no such token. Deleting makes it single-use even when two
+// requests race.
+func consumeUserToken(ctx context.Context, db *sql.DB, hash, purpose string) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, `DELETE FROM user_tokens WHERE token_hash = $1 AND purpose = $2 AND expires_at > $3 RETURNING user_id`,
+		hash, purpose, time.Now().UTC()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordResetVerifiesEmail follows a reset link as a user who never
+// verified their email. The new password and the verified email must both
+// be stored.
+func TestPasswordResetVerifiesEmail(t *testing.T) {
+	const newPassword = "Plum-Orchard-Lantern-42"
+
+	forEachStore(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		keys, err := loadKeySet(&Config{JWTSecret: strings.Repeat("x", minSecretLength)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewAPIServer(":0", store, keys)
+
+		user := newTestUser(t, store, "forgetful")
+		if err := store.SetEmailVerified(ctx, user.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		token, err := s.createUserToken(ctx, user, TokenResetPassword, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(PasswordResetConfirmRequest{Token: token, Password: newPassword})
+		req := httptest.NewRequest(http.MethodPost, "/password-reset/confirm", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("got %d %s, want 204", rec.Code, rec.Body)
+		}
+
+		reloaded, err := store.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reloaded.EmailVerified {
+			t.Error("email is not verified after the reset")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(reloaded.Password), []byte(newPassword)) != nil {
+			t.Error("new password was not stored")
+		}
+	})
+}